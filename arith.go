@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	算術式の評価 (declare -iの変数、配列の添字など)
+*/
+// 算術式を評価する
+// 変数名はその値を算術式として評価した値になり (未設定や空なら0)、代入演算子で変数に代入できる
+func (sh *Shell) Arith(expr string) (int64, error) {
+	a := arith{sh: sh, s: expr}
+	a.skipSpace()
+	if a.pos >= len(a.s) {
+		return 0, nil
+	}
+	v, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if a.pos < len(a.s) {
+		return 0, a.errorf("syntax error in expression")
+	}
+	return v, nil
+}
+
+// 変数の値を算術式として評価するときの深さの上限
+const maxArithDepth = 64
+
+type arith struct {
+	sh    *Shell
+	s     string
+	pos   int
+	depth int
+	skip  bool // &&や?:で評価しない側 (代入をしない)
+}
+
+func (a *arith) errorf(format string, args ...interface{}) error {
+	rest := strings.TrimSpace(a.s[a.pos:])
+	if rest == "" {
+		return fmt.Errorf("%s: %s", strings.TrimSpace(a.s), fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s: %s (error token is \"%s\")", strings.TrimSpace(a.s), fmt.Sprintf(format, args...), rest)
+}
+
+func (a *arith) skipSpace() {
+	for a.pos < len(a.s) && strings.IndexByte(" \t\n", a.s[a.pos]) >= 0 {
+		a.pos++
+	}
+}
+
+// 次の演算子がopなら読み進める
+func (a *arith) accept(op string) bool {
+	if !strings.HasPrefix(a.s[a.pos:], op) {
+		return false
+	}
+	a.pos += len(op)
+	a.skipSpace()
+	return true
+}
+
+// 次の演算子がopsのどれかなら読み進めてそれを返す
+// 長い演算子を先に並べる
+func (a *arith) acceptAny(ops ...string) string {
+	for _, op := range ops {
+		if !strings.HasPrefix(a.s[a.pos:], op) {
+			continue
+		}
+		// <と<=や<<=、&と&&などを区別する
+		next := a.s[a.pos+len(op):]
+		if strings.HasPrefix(next, "=") && !strings.HasSuffix(op, "=") && op != "!" {
+			continue
+		}
+		if len(op) == 1 && strings.HasPrefix(next, op) && strings.Contains("&|<>", op) {
+			continue
+		}
+		a.pos += len(op)
+		a.skipSpace()
+		return op
+	}
+	return ""
+}
+
+// expr, expr
+func (a *arith) comma() (int64, error) {
+	v, err := a.assign()
+	for err == nil && a.accept(",") {
+		v, err = a.assign()
+	}
+	return v, err
+}
+
+// name = expr, name += exprなど
+func (a *arith) assign() (int64, error) {
+	start := a.pos
+	name := a.name()
+	if name != "" {
+		ops := []string{"=", "+=", "-=", "*=", "/=", "%=", "<<=", ">>=", "&=", "^=", "|="}
+		for _, op := range ops {
+			if !strings.HasPrefix(a.s[a.pos:], op) || (op == "=" && strings.HasPrefix(a.s[a.pos:], "==")) {
+				continue
+			}
+			a.accept(op)
+			v, err := a.assign()
+			if err != nil {
+				return 0, err
+			}
+			if op != "=" {
+				old, err := a.variable(name)
+				if err != nil {
+					return 0, err
+				}
+				if v, err = binaryArith(op[:len(op)-1], old, v); err != nil {
+					return 0, a.errorf("%v", err)
+				}
+			}
+			return v, a.set(name, v)
+		}
+	}
+	a.pos = start
+	return a.ternary()
+}
+
+// cond ? a : b
+func (a *arith) ternary() (int64, error) {
+	cond, err := a.binary(0)
+	if err != nil || !a.accept("?") {
+		return cond, err
+	}
+
+	skip := a.skip
+	a.skip = skip || cond == 0
+	yes, err := a.assign()
+	if err != nil {
+		return 0, err
+	}
+	if !a.accept(":") {
+		return 0, a.errorf("`:' expected for conditional expression")
+	}
+	a.skip = skip || cond != 0
+	no, err := a.assign()
+	a.skip = skip
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return yes, nil
+	}
+	return no, nil
+}
+
+// 2項演算子を優先順位の低い順に並べたもの
+var arithLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// 優先順位level以上の2項演算子の式
+func (a *arith) binary(level int) (int64, error) {
+	if level == len(arithLevels) {
+		return a.power()
+	}
+
+	v, err := a.binary(level + 1)
+	for err == nil {
+		op := a.acceptAny(arithLevels[level]...)
+		if op == "" {
+			break
+		}
+
+		// &&と||は必要なときだけ右辺を評価する
+		skip := a.skip
+		if (op == "&&" && v == 0) || (op == "||" && v != 0) {
+			a.skip = true
+		}
+		var r int64
+		r, err = a.binary(level + 1)
+		a.skip = skip
+		if err != nil {
+			break
+		}
+		if v, err = binaryArith(op, v, r); err != nil {
+			err = a.errorf("%v", err)
+		}
+	}
+	return v, err
+}
+
+// a ** b (右結合)
+func (a *arith) power() (int64, error) {
+	v, err := a.unary()
+	if err != nil || !a.accept("**") {
+		return v, err
+	}
+	e, err := a.power()
+	if err != nil {
+		return 0, err
+	}
+	return binaryArith("**", v, e)
+}
+
+func (a *arith) unary() (int64, error) {
+	// ++name, --name
+	for _, op := range []string{"++", "--"} {
+		start := a.pos
+		if !a.accept(op) {
+			continue
+		}
+		if name := a.name(); name != "" {
+			v, err := a.variable(name)
+			if err != nil {
+				return 0, err
+			}
+			if op == "++" {
+				v++
+			} else {
+				v--
+			}
+			return v, a.set(name, v)
+		}
+		a.pos = start
+	}
+
+	switch op := a.acceptAny("!", "~", "+", "-"); op {
+	case "!":
+		v, err := a.unary()
+		if v == 0 {
+			return 1, err
+		}
+		return 0, err
+	case "~":
+		v, err := a.unary()
+		return ^v, err
+	case "+":
+		return a.unary()
+	case "-":
+		v, err := a.unary()
+		return -v, err
+	}
+	return a.postfix()
+}
+
+// name++, name--
+func (a *arith) postfix() (int64, error) {
+	start := a.pos
+	if name := a.name(); name != "" {
+		v, err := a.variable(name)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case a.accept("++"):
+			return v, a.set(name, v+1)
+		case a.accept("--"):
+			return v, a.set(name, v-1)
+		}
+		return v, nil
+	}
+	a.pos = start
+	return a.primary()
+}
+
+func (a *arith) primary() (int64, error) {
+	if a.accept("(") {
+		v, err := a.comma()
+		if err != nil {
+			return 0, err
+		}
+		if !a.accept(")") {
+			return 0, a.errorf("missing `)'")
+		}
+		return v, nil
+	}
+
+	start := a.pos
+	for a.pos < len(a.s) && isArithWordByte(a.s[a.pos]) {
+		a.pos++
+	}
+	word := a.s[start:a.pos]
+	a.skipSpace()
+	if word == "" {
+		return 0, a.errorf("syntax error: operand expected")
+	}
+	v, err := parseArithNumber(word)
+	if err != nil {
+		a.pos = start
+		return 0, a.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// 変数名 (name[subscript]を含む) を読む
+// 変数名でなければ何も読まずに""を返す
+func (a *arith) name() string {
+	start := a.pos
+	if a.pos >= len(a.s) || !(a.s[a.pos] == '_' || isLetter(a.s[a.pos])) {
+		return ""
+	}
+	for a.pos < len(a.s) && (a.s[a.pos] == '_' || isLetter(a.s[a.pos]) || isDigit(a.s[a.pos])) {
+		a.pos++
+	}
+	if a.pos < len(a.s) && a.s[a.pos] == '[' {
+		if j := strings.IndexByte(a.s[a.pos:], ']'); j != -1 {
+			a.pos += j + 1
+		}
+	}
+	name := a.s[start:a.pos]
+	a.skipSpace()
+	return name
+}
+
+// 変数の値を算術式として評価する
+func (a *arith) variable(name string) (int64, error) {
+	v := a.sh.Get(name)
+	if strings.TrimSpace(v) == "" {
+		return 0, nil
+	}
+	if a.depth >= maxArithDepth {
+		return 0, a.errorf("expression recursion level exceeded")
+	}
+	sub := arith{sh: a.sh, s: v, depth: a.depth + 1}
+	sub.skipSpace()
+	n, err := sub.comma()
+	if err == nil && sub.pos < len(sub.s) {
+		err = sub.errorf("syntax error in expression")
+	}
+	return n, err
+}
+
+func (a *arith) set(name string, v int64) error {
+	if a.skip {
+		return nil
+	}
+	return a.sh.Assign(name + "=" + strconv.FormatInt(v, 10))
+}
+
+func binaryArith(op string, x, y int64) (int64, error) {
+	b := func(c bool) int64 {
+		if c {
+			return 1
+		}
+		return 0
+	}
+	switch op {
+	case "||":
+		return b(x != 0 || y != 0), nil
+	case "&&":
+		return b(x != 0 && y != 0), nil
+	case "|":
+		return x | y, nil
+	case "^":
+		return x ^ y, nil
+	case "&":
+		return x & y, nil
+	case "==":
+		return b(x == y), nil
+	case "!=":
+		return b(x != y), nil
+	case "<":
+		return b(x < y), nil
+	case "<=":
+		return b(x <= y), nil
+	case ">":
+		return b(x > y), nil
+	case ">=":
+		return b(x >= y), nil
+	case "<<":
+		return x << uint64(y), nil
+	case ">>":
+		return x >> uint64(y), nil
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, fmt.Errorf("division by 0")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "**":
+		if y < 0 {
+			return 0, fmt.Errorf("exponent less than 0")
+		}
+		return powArith(x, y), nil
+	}
+	return 0, fmt.Errorf("%s: unknown operator", op)
+}
+
+// x ** y (y >= 0)
+// 2乗を繰り返して求める。桁あふれは掛け算と同じく切り捨てる
+func powArith(x, y int64) int64 {
+	switch {
+	case y == 0 || x == 1:
+		return 1
+	case x == 0:
+		return 0
+	case x == -1:
+		if y%2 == 0 {
+			return 1
+		}
+		return -1
+	}
+	r := int64(1)
+	for y > 0 {
+		if y&1 != 0 {
+			r *= x
+		}
+		x *= x
+		y >>= 1
+	}
+	return r
+}
+
+// 10進数、0xで始まる16進数、0で始まる8進数、base#nの形の数値
+func parseArithNumber(s string) (int64, error) {
+	if b, n, ok := strings.Cut(s, "#"); ok {
+		base, err := strconv.Atoi(b)
+		if err != nil || base < 2 || base > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base")
+		}
+		var v int64
+		for _, c := range n {
+			d := strings.IndexRune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ@_", c)
+			if base <= 36 && 'A' <= c && c <= 'Z' {
+				d = int(c-'A') + 10
+			}
+			if d < 0 || d >= base {
+				return 0, fmt.Errorf("value too great for base")
+			}
+			v = v*int64(base) + int64(d)
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		if isDigit(s[0]) {
+			return 0, fmt.Errorf("value too great for base")
+		}
+		return 0, fmt.Errorf("syntax error: operand expected")
+	}
+	return v, nil
+}
+
+func isArithWordByte(c byte) bool {
+	return c == '_' || c == '#' || c == '@' || isLetter(c) || isDigit(c)
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+/*
+	let組み込みコマンド
+*/
+// let expr...
+// 各引数を算術式として評価する。最後の式の値が0なら1、それ以外なら0を返す
+func Let(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 2 {
+		return 1, fmt.Errorf("let: expression expected")
+	}
+	var v int64
+	for _, expr := range args[1:] {
+		var err error
+		if v, err = ca.Sh.Arith(expr); err != nil {
+			return 1, fmt.Errorf("let: %w", err)
+		}
+	}
+	if v == 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestArith(t *testing.T) {
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"7 / 2", 3},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 3", -8},
+		{"3 ** 40", -6289078614652622815},
+		{"2 ** 63", math.MinInt64},
+		{"2 ** 64", 0},
+		{"0 ** 0", 1},
+		{"0 ** 9999999999", 0},
+		{"1 ** 9999999999", 1},
+		{"(-1) ** 9999999999", -1},
+		{"(-1) ** 9999999998", 1},
+		{"2 ** 9999999999", 0},
+		{"1 << 4 | 1", 17},
+		{"6 & 3 ^ 1", 3},
+		{"!0 + ~0", 0},
+		{"1 < 2 && 2 <= 2", 1},
+		{"0 || 0", 0},
+		{"3 == 3 != 0", 1},
+		{"1 ? 10 : 20", 10},
+		{"0 ? 10 : 0 ? 20 : 30", 30},
+		{"0x1f + 010 + 2#101", 31 + 8 + 5},
+		{"x = 5, x * 2", 10},
+		{"y = 3, y += 4, y", 7},
+		{"z = 1, z <<= 3", 8},
+		{"n = 1, n++ + n", 3},
+		{"m = 1, ++m + m", 4},
+		{"unset + 1", 1},
+		{"0 && (w = 1), w", 0},
+	}
+	for _, tt := range tests {
+		sh := NewShell()
+		got, err := sh.Arith(tt.expr)
+		if err != nil {
+			t.Errorf("Arith(%q): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Arith(%q) = %d, want %d", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestArithErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{"1 / 0", "division by 0"},
+		{"1 % 0", "division by 0"},
+		{"2 ** -1", "exponent less than 0"},
+		{"1 +", "syntax error"},
+		{"1 ? 2", "`:' expected"},
+		{"(1", "missing `)'"},
+		{"1 2", "syntax error in expression"},
+		{"64#1", ""},
+		{"65#1", "invalid arithmetic base"},
+	}
+	for _, tt := range tests {
+		sh := NewShell()
+		_, err := sh.Arith(tt.expr)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("Arith(%q): %v", tt.expr, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Arith(%q) error = %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestArithVariables(t *testing.T) {
+	sh := NewShell()
+	sh.Vars["a"] = "b + 1"
+	sh.Vars["b"] = "2"
+	if got, err := sh.Arith("a * 2"); err != nil || got != 6 {
+		t.Errorf("Arith(a * 2) = %d, %v, want 6", got, err)
+	}
+	sh.Vars["r"] = "r"
+	if _, err := sh.Arith("r"); err == nil {
+		t.Errorf("Arith(r) with r=r: expected an error")
+	}
+	sh.Readonly["c"] = true
+	if _, err := sh.Arith("c = 1"); err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("Arith(c = 1) with readonly c: error = %v", err)
+	}
+}
+
+func TestDeclareInteger(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"evaluate", `declare -i n; n=2*3+1; echo $n`, "7\n"},
+		{"on declare", `declare -i n=1+1; echo $n`, "2\n"},
+		{"variables", `a=4; declare -i n; n=a*a; echo $n`, "16\n"},
+		{"power", `declare -i n; n=2**9999999999; echo $n`, "0\n"},
+		{"print", `declare -i n=3; declare -p n`, "declare -i n=\"3\"\n"},
+		{"remove", `declare -i n; declare +i n; n=1+1; echo $n`, "1+1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestLet(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"assign", `let "i = 1 + 2"; echo $? $i`, "0 3\n"},
+		{"increment", `i=1; let i++; echo $i`, "2\n"},
+		{"prefix decrement", `i=5; let --i; echo $i`, "4\n"},
+		{"compound", `i=3; let "i += 4" "i *= 2"; echo $i`, "14\n"},
+		{"zero status", `let "x = 0"; echo $?`, "1\n"},
+		{"last expression", `let 1 0; echo $?; let 0 1; echo $?`, "1\n0\n"},
+		{"post increment from zero", `i=0; let i++; echo $? $i`, "1 1\n"},
+		{"huge power", `let "x = 2 ** 9999999999"; echo $? $x`, "1 0\n"},
+		{"power", `let "x = 3 ** 4"; echo $x`, "81\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestLetErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`let`, "expression expected"},
+		{`let "1 / 0"`, "division by 0"},
+		{`let "2 ** -1"`, "exponent less than 0"},
+		{`readonly r=1; let r++`, "r: readonly variable"},
+	}
+	for _, tt := range tests {
+		out, errOut, _ := runShell(t, tt.src+"; echo $?")
+		if out != "1\n" || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q (stderr %q), want status 1 and %q", tt.src, out, errOut, tt.err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	配列変数
+*/
+// NAME[subscript]をNAMEとsubscriptに分ける
+func splitSubscript(s string) (name, sub string, ok bool) {
+	i := strings.IndexByte(s, '[')
+	if i <= 0 || !strings.HasSuffix(s, "]") || !IsName(s[:i]) {
+		return "", "", false
+	}
+	return s[:i], s[i+1 : len(s)-1], true
+}
+
+// 添字が全要素 (@か*) か
+func allElements(name string) bool {
+	_, sub, ok := splitSubscript(name)
+	return ok && (sub == "@" || sub == "*")
+}
+
+// 代入できる添字の上限
+const maxArrayIndex = 1 << 20
+
+// 配列全体を設定する
+func (sh *Shell) SetArray(name string, values []string) {
+	delete(sh.Vars, name)
+	delete(sh.Assoc, name)
+	sh.Arrays[name] = values
+}
+
+// 空の連想配列を作る
+// 配列でない変数の値はキー0の値になる
+func (sh *Shell) DeclareAssoc(name string) error {
+	if _, ok := sh.Assoc[name]; ok {
+		return nil
+	}
+	if _, ok := sh.Arrays[name]; ok {
+		return fmt.Errorf("%s: cannot convert indexed to associative array", name)
+	}
+	m := map[string]string{}
+	if v, ok := sh.Vars[name]; ok {
+		m["0"] = v
+		delete(sh.Vars, name)
+	}
+	sh.Assoc[name] = m
+	return nil
+}
+
+// 添字を展開して算術式として評価し、長さnの配列のインデックスにする
+// 負の値は末尾から数える
+func (sh *Shell) index(sub string, n int) (int, error) {
+	s, err := sh.ExpandVars(sub)
+	if err != nil {
+		return 0, err
+	}
+	v, err := sh.Arith(s)
+	if err != nil {
+		return 0, err
+	}
+	i := int(v)
+	if i < 0 {
+		i += n
+		if i < 0 {
+			return 0, fmt.Errorf("%s: bad array subscript", sub)
+		}
+	}
+	return i, nil
+}
+
+// NAME=(...)を処理
+// 変数の属性に従う。連想配列なら各要素は[key]=valueの形
+func (sh *Shell) AssignArray(name string, values []string) error {
+	if sh.Readonly[name] {
+		return fmt.Errorf("%s: readonly variable", name)
+	}
+	if _, ok := sh.Assoc[name]; ok {
+		m := map[string]string{}
+		for _, v := range values {
+			key, value, ok := strings.Cut(v, "]=")
+			if !strings.HasPrefix(key, "[") || !ok {
+				return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, v)
+			}
+			var err error
+			if m[key[1:]], err = sh.attrValue(name, value); err != nil {
+				return err
+			}
+		}
+		sh.Assoc[name] = m
+		return nil
+	}
+	for i, v := range values {
+		var err error
+		if values[i], err = sh.attrValue(name, v); err != nil {
+			return err
+		}
+	}
+	sh.SetArray(name, values)
+	return nil
+}
+
+// NAME[subscript]=valueを処理
+// 配列より後ろの要素に代入すると、間の要素は空文字列になる
+func (sh *Shell) SetElement(name, sub, value string) error {
+	if m, ok := sh.Assoc[name]; ok {
+		key, err := sh.ExpandVars(sub)
+		if err != nil {
+			return err
+		}
+		if m[key], err = sh.attrValue(name, value); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	arr, ok := sh.Arrays[name]
+	if !ok {
+		// 配列でない変数は要素0として扱う
+		if v, set := sh.Vars[name]; set {
+			arr = []string{v}
+		}
+	}
+	i, err := sh.index(sub, len(arr))
+	if err != nil {
+		return err
+	}
+	// 配列は詰めて持つので、間を空ける大きな添字は使えない
+	if i >= maxArrayIndex {
+		return fmt.Errorf("%s[%s]: array index too large (max %d)", name, sub, maxArrayIndex-1)
+	}
+	if value, err = sh.attrValue(name, value); err != nil {
+		return err
+	}
+	for len(arr) <= i {
+		arr = append(arr, "")
+	}
+	arr[i] = value
+	sh.SetArray(name, arr)
+	return nil
+}
+
+// 配列の要素をすべて返す
+// 配列でない変数は要素が1つの配列として扱う
+// 連想配列はキーの順に並べる
+func (sh *Shell) Elements(name string) []string {
+	if arr, ok := sh.Arrays[name]; ok {
+		return append([]string{}, arr...)
+	}
+	if m, ok := sh.Assoc[name]; ok {
+		var elems []string
+		for _, k := range sh.Keys(name) {
+			elems = append(elems, m[k])
+		}
+		return elems
+	}
+	if v, ok := sh.Lookup(name); ok {
+		return []string{v}
+	}
+	return nil
+}
+
+// ${NAME[subscript]}の値
+func (sh *Shell) element(name, sub string) (string, bool) {
+	if sub == "@" || sub == "*" {
+		elems := sh.Elements(name)
+		return strings.Join(elems, " "), len(elems) > 0
+	}
+
+	if m, ok := sh.Assoc[name]; ok {
+		key, err := sh.ExpandVars(sub)
+		if err != nil {
+			return "", false
+		}
+		v, ok := m[key]
+		return v, ok
+	}
+
+	elems := sh.Elements(name)
+	i, err := sh.index(sub, len(elems))
+	if err != nil || i >= len(elems) {
+		return "", false
+	}
+	return elems[i], true
+}
+
+// 配列の添字の一覧 (${!NAME[@]})
+// 連想配列のキーは文字列の順に並べる
+func (sh *Shell) Keys(name string) []string {
+	var keys []string
+	if m, ok := sh.Assoc[name]; ok {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	for i := range sh.Elements(name) {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	return keys
+}
+
+// "$@"や"${NAME[@]}"のように、要素ごとに別の単語になる展開か
+// そうなら要素を返す
+func (sh *Shell) Words(name string) ([]string, bool) {
+	if name == "@" {
+		return sh.Args, true
+	}
+	if allElements(name) {
+		base, sub, _ := splitSubscript(name)
+		if sub == "@" {
+			return sh.Elements(base), true
+		}
+	}
+	return nil, false
+}
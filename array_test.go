@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArrays(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"element", `a=(x "y z" w); echo ${a[1]}`, "y z\n"},
+		{"length", `a=(x "y z" w); echo ${#a[@]}`, "3\n"},
+		{"all elements", `a=(x "y z" w); for e in "${a[@]}"; do echo "[$e]"; done`, "[x]\n[y z]\n[w]\n"},
+		{"empty elements", `a=(x "" y); for e in "${a[@]}"; do echo "[$e]"; done`, "[x]\n[]\n[y]\n"},
+		{"empty array", `a=(); for e in "${a[@]}"; do echo "[$e]"; done; echo end`, "end\n"},
+		{"empty array with prefix", `a=(); for e in "x${a[@]}"; do echo "[$e]"; done`, "[x]\n"},
+		{"negative index", `a=(x y w); echo ${a[-1]}`, "w\n"},
+		{"assign element", `a=(x); a[2]=z; echo ${#a[@]} ${a[2]}`, "3 z\n"},
+		{"assign negative", `a=(x y); a[-1]=z; echo ${a[@]}`, "x z\n"},
+		{"arithmetic index", `a=(x y z); i=1; echo ${a[i+1]}`, "z\n"},
+		{"name is element 0", `a=(x y); echo $a`, "x\n"},
+		{"scalar becomes array", `b=1; b[1]=2; echo ${b[@]}`, "1 2\n"},
+		{"element length", `a=(x abc); echo ${#a[1]}`, "3\n"},
+		{"keys", `a=(x y z); echo ${!a[@]}`, "0 1 2\n"},
+		{"associative", `declare -A m; m[k]=v; m[j]=u; echo ${m[k]} ${!m[@]}`, "v j k\n"},
+		{"largest index", `a[1048575]=x; echo ${#a[@]}`, "1048576\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestArrayErrors(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"huge index", `a[3000000000]=x; echo ${#a[@]}`, "0\n", "array index too large"},
+		{"index limit", `a=(x); a[1048576]=y; echo ${#a[@]}`, "1\n", "array index too large"},
+		{"bad negative index", `a=(x); a[-2]=y; echo ${a[@]}`, "x\n", "bad array subscript"},
+		{"readonly", `readonly a; a[0]=x; echo "[${a[0]}]"`, "[]\n", "a: readonly variable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want %q and %q", tt.src, out, errOut, tt.out, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+	組み込みコマンド
+*/
+// 組み込みコマンドの関数
+// args[0]はコマンド名
+type Builtin func(ca *CmdArg, args []string) (int, error)
+
+var builtins map[string]Builtin
+
+func init() {
+	builtins = map[string]Builtin{
+		"break":     Break,
+		"continue":  Continue,
+		"return":    Return,
+		"exit":      Exit,
+		"exec":      ExecCmd,
+		"shift":     Shift,
+		"set":       Set,
+		"echo":      Echo,
+		"pwd":       Pwd,
+		"command":   Command,
+		"builtin":   RunBuiltin,
+		"umask":     Umask,
+		"times":     Times,
+		"cd":        Cd,
+		"getopts":   Getopts,
+		"local":     Local,
+		"read":      Read,
+		"mapfile":   Mapfile,
+		"readarray": Mapfile,
+		"printf":    Printf,
+		"test":      Test,
+		"[":         Test,
+		"export":    ExportCmd,
+		"declare":   Declare,
+		"readonly":  Readonly,
+		"typeset":   Declare,
+		"trap":      Trap,
+		"eval":      EvalCmd,
+		"let":       Let,
+		"enable":    Enable,
+		"shopt":     Shopt,
+		"env":       Env,
+		"printenv":  Printenv,
+		"source":    Source,
+		".":         Source,
+	}
+}
+
+// nameの組み込みコマンドを返す
+// enable -nで無効にしたものは組み込みコマンドとして扱わない
+func (sh *Shell) Builtin(name string) (Builtin, bool) {
+	f, ok := builtins[name]
+	if !ok || sh.Disabled[name] {
+		return nil, false
+	}
+	return f, true
+}
+
+// break [n]
+func Break(ca *CmdArg, args []string) (int, error) {
+	return loopControl(ca, args, true)
+}
+
+// continue [n]
+func Continue(ca *CmdArg, args []string) (int, error) {
+	return loopControl(ca, args, false)
+}
+
+func loopControl(ca *CmdArg, args []string, brk bool) (int, error) {
+	n := 1
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return 1, fmt.Errorf("%s: %s: loop count out of range", args[0], args[1])
+		}
+	}
+
+	// ループの外では何もしない
+	lc := &LoopControl{Break: brk, N: n}
+	if ca.Sh.LoopDepth == 0 {
+		return 0, fmt.Errorf("%s", lc.Error())
+	}
+
+	// ループの段数より多ければ一番外側まで抜ける
+	if lc.N > ca.Sh.LoopDepth {
+		lc.N = ca.Sh.LoopDepth
+	}
+	return 0, lc
+}
+
+// return [n]
+// nを省略すると直前のコマンドの終了ステータスを返す
+func Return(ca *CmdArg, args []string) (int, error) {
+	rc := &ReturnControl{Status: ca.Sh.Status}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 2, fmt.Errorf("return: %s: numeric argument required", args[1])
+		}
+		rc.Status = n & 0xff
+	}
+
+	if ca.Sh.FuncDepth == 0 {
+		return 1, fmt.Errorf("%s", rc.Error())
+	}
+	return rc.Status, rc
+}
+
+// exit [n]
+// シェルを終了する。nを省略すると直前のコマンドの終了ステータスで終了する
+// EXITのtrapは終了する前に実行する
+func Exit(ca *CmdArg, args []string) (int, error) {
+	ec := &ExitControl{Status: ca.Sh.Status}
+	if len(args) > 2 {
+		return 1, fmt.Errorf("exit: too many arguments")
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			ca.Sh.Error(fmt.Errorf("exit: %s: numeric argument required", args[1]))
+			ec.Status = 2
+		} else {
+			ec.Status = n & 0xff
+		}
+	}
+	return ec.Status, ec
+}
+
+// exec [command [args...]]
+// commandがあれば外部コマンドとして実行し、その終了ステータスでシェルを終了する
+// commandがなければ、exec 3> fileやexec 3>&-のリダイレクトをシェルの入出力として残す
+func ExecCmd(ca *CmdArg, args []string) (int, error) {
+	if len(args) == 1 {
+		ca.Sh.KeepStdio(ca)
+		return 0, nil
+	}
+	ca.Cmd = args[1:]
+	status, err := ca.RunExternal()
+	if err != nil {
+		// 対話モードでは実行できなくても終了しない
+		if ca.Sh.Interactive {
+			return status, err
+		}
+		ca.Sh.Error(err)
+	}
+	return status, &ExitControl{Status: status}
+}
+
+// evalの入れ子の深さの上限
+const maxEvalDepth = 100
+
+// eval [arg...]
+// 引数を空白でつなげて、現在のシェルでコマンドとして実行する
+func EvalCmd(ca *CmdArg, args []string) (int, error) {
+	if ca.Sh.evalDepth >= maxEvalDepth {
+		return 1, fmt.Errorf("eval: maximum eval nesting level exceeded (%d)", maxEvalDepth)
+	}
+	ca.Sh.evalDepth++
+	defer func() { ca.Sh.evalDepth-- }()
+	return ca.Eval(strings.Join(args[1:], " "))
+}
+
+// shift [n]
+// 位置パラメータをn個捨てる
+func Shift(ca *CmdArg, args []string) (int, error) {
+	n := 1
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil {
+			return 1, fmt.Errorf("shift: %s: numeric argument required", args[1])
+		}
+	}
+	if n < 0 || n > len(ca.Sh.Args) {
+		return 1, fmt.Errorf("shift: %d: shift count out of range", n)
+	}
+
+	ca.Sh.Args = ca.Sh.Args[n:]
+	return 0, nil
+}
+
+// local name[=value]...
+// 関数の中だけで使う変数を作る。値がなければ未設定にする
+func Local(ca *CmdArg, args []string) (int, error) {
+	if ca.Sh.FuncDepth == 0 {
+		return 1, fmt.Errorf("local: can only be used in a function")
+	}
+
+	status := 0
+	for _, a := range args[1:] {
+		name, value, hasValue := strings.Cut(a, "=")
+		if !IsName(name) {
+			ca.Sh.Error(fmt.Errorf("local: `%s': not a valid identifier", a))
+			status = 1
+			continue
+		}
+		if ca.Sh.Readonly[name] {
+			ca.Sh.Error(fmt.Errorf("local: %s: readonly variable", name))
+			status = 1
+			continue
+		}
+		ca.Sh.Local(name)
+		if hasValue {
+			if err := ca.Sh.SetVar(name, value); err != nil {
+				ca.Sh.Error(fmt.Errorf("local: %v", err))
+				status = 1
+			}
+		} else {
+			delete(ca.Sh.Vars, name)
+		}
+	}
+	return status, nil
+}
+
+// export [-n] [-p] [name[=value]...]
+// 変数を子プロセスに渡すようにする。-nなら渡さないようにする
+// 引数がなければexportした変数を一覧表示する
+func ExportCmd(ca *CmdArg, args []string) (int, error) {
+	args = args[1:]
+	unexport := false
+	for len(args) > 0 && (args[0] == "-n" || args[0] == "-p") {
+		unexport = unexport || args[0] == "-n"
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		var names []string
+		for name := range ca.Sh.Exported {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v, ok := ca.Sh.Vars[name]; ok {
+				fmt.Fprintf(ca.Sh.Out, "export %s=%s\n", name, strconv.Quote(v))
+			} else {
+				fmt.Fprintf(ca.Sh.Out, "export %s\n", name)
+			}
+		}
+		return 0, nil
+	}
+
+	status := 0
+	for _, a := range args {
+		name, value, hasValue := strings.Cut(a, "=")
+		if !IsName(name) {
+			ca.Sh.Error(fmt.Errorf("export: `%s': not a valid identifier", a))
+			status = 1
+			continue
+		}
+		if unexport {
+			delete(ca.Sh.Exported, name)
+			continue
+		}
+		if !hasValue {
+			ca.Sh.Exported[name] = true
+			continue
+		}
+		if err := ca.Sh.Export(name, value); err != nil {
+			ca.Sh.Error(fmt.Errorf("export: %w", err))
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// declare [-aAirx] [+ix] [-p] [name[=value]...]
+// 変数に属性を付けて代入する。関数の中ではローカル変数になる
+// -aは配列、-Aは連想配列、-iは整数、-rは読み込み専用、-xはexport。+で属性を外す
+// nameがなければ変数を一覧表示する (属性を指定したらその属性の変数だけ)
+func Declare(ca *CmdArg, args []string) (int, error) {
+	sh := ca.Sh
+	cmd := args[0]
+	args = args[1:]
+
+	on := map[byte]bool{}
+	off := map[byte]bool{}
+	for len(args) > 0 && len(args[0]) > 1 && (args[0][0] == '-' || args[0][0] == '+') {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		for j := 1; j < len(args[0]); j++ {
+			c := args[0][j]
+			if strings.IndexByte("aAirxp", c) < 0 {
+				return 2, fmt.Errorf("%s: %c%c: invalid option", cmd, args[0][0], c)
+			}
+			if args[0][0] == '-' {
+				on[c] = true
+			} else {
+				off[c] = true
+			}
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		sh.PrintDeclared(on)
+		return 0, nil
+	}
+
+	status := 0
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		name, value, hasValue := strings.Cut(a, "=")
+
+		// name=( ... )
+		var words []string
+		isArray := false
+		if hasValue && value == "" && i+1 < len(args) && args[i+1] == "(" {
+			end := len(args)
+			for j := i + 2; j < len(args); j++ {
+				if args[j] == ")" {
+					end = j
+					break
+				}
+			}
+			words = args[i+2 : end]
+			isArray = true
+			i = end
+		}
+
+		if !IsName(name) {
+			sh.Error(fmt.Errorf("%s: `%s': not a valid identifier", cmd, a))
+			status = 1
+			continue
+		}
+		if on['p'] {
+			if !sh.printDeclared(name) {
+				sh.Error(fmt.Errorf("%s: %s: not found", cmd, name))
+				status = 1
+			}
+			continue
+		}
+		if off['r'] && sh.Readonly[name] {
+			sh.Error(fmt.Errorf("%s: %s: readonly variable", cmd, name))
+			status = 1
+			continue
+		}
+		if sh.FuncDepth > 0 {
+			sh.Local(name)
+		}
+
+		if on['i'] {
+			sh.Integers[name] = true
+		}
+		if off['i'] {
+			delete(sh.Integers, name)
+		}
+		if on['x'] {
+			sh.Exported[name] = true
+		}
+		if off['x'] {
+			delete(sh.Exported, name)
+		}
+		if on['a'] {
+			if _, ok := sh.Assoc[name]; ok {
+				sh.Error(fmt.Errorf("%s: %s: cannot convert associative to indexed array", cmd, name))
+				status = 1
+				continue
+			}
+			if _, ok := sh.Arrays[name]; !ok {
+				sh.SetArray(name, sh.Elements(name))
+			}
+		}
+		if on['A'] {
+			if err := sh.DeclareAssoc(name); err != nil {
+				sh.Error(fmt.Errorf("%s: %w", cmd, err))
+				status = 1
+				continue
+			}
+		}
+
+		var err error
+		switch {
+		case isArray:
+			err = sh.AssignArray(name, words)
+		case hasValue:
+			err = sh.SetVar(name, value)
+		}
+		if err != nil {
+			sh.Error(fmt.Errorf("%s: %w", cmd, err))
+			status = 1
+			continue
+		}
+		if on['r'] {
+			sh.Readonly[name] = true
+		}
+	}
+	return status, nil
+}
+
+// readonly [-p] [name[=value]...]
+// 変数を代入できないようにする。関数の中でもグローバル変数のまま
+// nameがなければreadonlyの変数を一覧表示する
+func Readonly(ca *CmdArg, args []string) (int, error) {
+	sh := ca.Sh
+	args = args[1:]
+	for len(args) > 0 && (args[0] == "-p" || args[0] == "--") {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		sh.PrintDeclared(map[byte]bool{'r': true})
+		return 0, nil
+	}
+
+	status := 0
+	for _, a := range args {
+		name, value, hasValue := strings.Cut(a, "=")
+		if !IsName(name) {
+			sh.Error(fmt.Errorf("readonly: `%s': not a valid identifier", a))
+			status = 1
+			continue
+		}
+		if hasValue {
+			if err := sh.SetVar(name, value); err != nil {
+				sh.Error(fmt.Errorf("readonly: %w", err))
+				status = 1
+				continue
+			}
+		}
+		sh.Readonly[name] = true
+	}
+	return status, nil
+}
+
+// 変数の属性をdeclareのオプションの形で返す
+func (sh *Shell) declareFlags(name string) string {
+	flags := ""
+	if _, ok := sh.Arrays[name]; ok {
+		flags += "a"
+	}
+	if _, ok := sh.Assoc[name]; ok {
+		flags += "A"
+	}
+	if sh.Integers[name] {
+		flags += "i"
+	}
+	if sh.Readonly[name] {
+		flags += "r"
+	}
+	if sh.Exported[name] {
+		flags += "x"
+	}
+	return flags
+}
+
+// 変数をdeclareで作り直せる形で表示する
+// 変数も属性もなければfalse
+func (sh *Shell) printDeclared(name string) bool {
+	flags := sh.declareFlags(name)
+	if flags == "" {
+		flags = "-"
+	}
+
+	if arr, ok := sh.Arrays[name]; ok {
+		elems := make([]string, len(arr))
+		for i, v := range arr {
+			elems[i] = fmt.Sprintf("[%d]=%s", i, strconv.Quote(v))
+		}
+		fmt.Fprintf(sh.Out, "declare -%s %s=(%s)\n", flags, name, strings.Join(elems, " "))
+		return true
+	}
+	if m, ok := sh.Assoc[name]; ok {
+		var elems []string
+		for _, k := range sh.Keys(name) {
+			elems = append(elems, fmt.Sprintf("[%s]=%s", k, strconv.Quote(m[k])))
+		}
+		fmt.Fprintf(sh.Out, "declare -%s %s=(%s)\n", flags, name, strings.Join(elems, " "))
+		return true
+	}
+	if v, ok := sh.Vars[name]; ok {
+		fmt.Fprintf(sh.Out, "declare -%s %s=%s\n", flags, name, strconv.Quote(v))
+		return true
+	}
+	if flags != "-" {
+		fmt.Fprintf(sh.Out, "declare -%s %s\n", flags, name)
+		return true
+	}
+	return false
+}
+
+// シェル変数を名前順に表示する
+// attrsが空でなければ、その属性をすべて持つ変数だけを表示する
+func (sh *Shell) PrintDeclared(attrs map[byte]bool) {
+	seen := map[string]bool{}
+	for _, m := range []map[string]bool{sh.Exported, sh.Readonly, sh.Integers} {
+		for name := range m {
+			seen[name] = true
+		}
+	}
+	for name := range sh.Vars {
+		seen[name] = true
+	}
+	for name := range sh.Arrays {
+		seen[name] = true
+	}
+	for name := range sh.Assoc {
+		seen[name] = true
+	}
+
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flags := sh.declareFlags(name)
+		match := true
+		for c := range attrs {
+			if c != 'p' && strings.IndexByte(flags, c) < 0 {
+				match = false
+			}
+		}
+		if match {
+			sh.printDeclared(name)
+		}
+	}
+}
+
+// set -oで切り替えるオプションの名前
+var optionNames = []string{"color", "failglob", "noclobber", "noexec", "nounset", "nullglob", "pipefail", "posix"}
+
+// 同時に有効にできないオプション
+var exclusiveOptions = map[string]string{
+	"failglob": "nullglob",
+	"nullglob": "failglob",
+}
+
+// 1文字のオプションとset -oの名前の対応
+var shortOptions = map[byte]string{
+	'C': "noclobber",
+	'n': "noexec",
+	'u': "nounset",
+}
+
+// set [-Cnu] [+Cnu] [-o name] [+o name]
+// set -o
+// set timeout [seconds]
+// -で有効、+で無効にする。-oだけならオプションの一覧を表示する
+// 秒数を省略すると現在のタイムアウトを表示する
+func Set(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 2 {
+		return 2, fmt.Errorf("set: usage: set [-Cn] [-o name] [timeout [seconds]]")
+	}
+
+	if args[1] == "timeout" {
+		if len(args) == 2 {
+			fmt.Fprintf(ca.Sh.Out, "timeout %d\n", ca.Sh.Timeout)
+			return 0, nil
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return 1, fmt.Errorf("set: %s: invalid timeout", args[2])
+		}
+		ca.Sh.Timeout = n
+		return 0, nil
+	}
+
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		if len(a) < 2 || (a[0] != '-' && a[0] != '+') {
+			return 2, fmt.Errorf("set: %s: invalid option", a)
+		}
+		on := a[0] == '-'
+
+		// -o name
+		if a[1:] == "o" {
+			if i+1 == len(args) {
+				ca.Sh.PrintOptions(on)
+				return 0, nil
+			}
+			i++
+			if !ca.Sh.SetOption(args[i], on) {
+				return 2, fmt.Errorf("set: %s: invalid option name", args[i])
+			}
+			continue
+		}
+
+		for j := 1; j < len(a); j++ {
+			name, ok := shortOptions[a[j]]
+			if !ok {
+				return 2, fmt.Errorf("set: %c%c: invalid option", a[0], a[j])
+			}
+			ca.Sh.SetOption(name, on)
+		}
+	}
+	return 0, nil
+}
+
+// オプションを設定する
+// 知らない名前ならfalseを返す
+func (sh *Shell) SetOption(name string, on bool) bool {
+	for _, n := range optionNames {
+		if n == name {
+			sh.Options[name] = on
+			if other, ok := exclusiveOptions[name]; ok && on {
+				sh.Options[other] = false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// オプションの一覧を表示する
+// reusableならset -oで読み込める形式で表示する
+func (sh *Shell) PrintOptions(reusable bool) {
+	for _, name := range optionNames {
+		if reusable {
+			state := "off"
+			if sh.Options[name] {
+				state = "on"
+			}
+			fmt.Fprintf(sh.Out, "%-15s\t%s\n", name, state)
+			continue
+		}
+		sign := "+"
+		if sh.Options[name] {
+			sign = "-"
+		}
+		fmt.Fprintf(sh.Out, "set %so %s\n", sign, name)
+	}
+}
+
+// shopt [-pqsu] [name...]
+// set -oと同じオプションを-sで有効に、-uで無効にする
+// -qなら何も表示せず、nameがすべて有効なら0を返す
+// それ以外はnameの (なければ全部の) オプションの状態を表示する。-pならshoptで読み込める形式
+func Shopt(ca *CmdArg, args []string) (int, error) {
+	sh := ca.Sh
+	var set, unset, quiet, reusable bool
+	i := 1
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, c := range args[i][1:] {
+			switch c {
+			case 's':
+				set = true
+			case 'u':
+				unset = true
+			case 'q':
+				quiet = true
+			case 'p':
+				reusable = true
+			default:
+				return 2, fmt.Errorf("shopt: -%c: invalid option", c)
+			}
+		}
+	}
+	if set && unset {
+		return 1, fmt.Errorf("shopt: cannot set and unset shell options simultaneously")
+	}
+
+	names := args[i:]
+	for _, name := range names {
+		if !slices.Contains(optionNames, name) {
+			return 1, fmt.Errorf("shopt: %s: invalid shell option name", name)
+		}
+	}
+
+	// -s name, -u name
+	if (set || unset) && len(names) > 0 {
+		for _, name := range names {
+			sh.SetOption(name, set)
+		}
+		return 0, nil
+	}
+
+	// -sと-uだけなら有効 (無効) なオプションを表示する
+	if len(names) == 0 {
+		for _, name := range optionNames {
+			if (set && !sh.Options[name]) || (unset && sh.Options[name]) {
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+
+	status := 0
+	for _, name := range names {
+		on := sh.Options[name]
+		if !on {
+			status = 1
+		}
+		switch {
+		case quiet:
+		case reusable:
+			flag := "-u"
+			if on {
+				flag = "-s"
+			}
+			fmt.Fprintf(sh.Out, "shopt %s %s\n", flag, name)
+		default:
+			state := "off"
+			if on {
+				state = "on"
+			}
+			fmt.Fprintf(sh.Out, "%-15s\t%s\n", name, state)
+		}
+	}
+	if len(args[i:]) == 0 && !quiet {
+		return 0, nil
+	}
+	return status, nil
+}
+
+// echo [-n] args...
+func Echo(ca *CmdArg, args []string) (int, error) {
+	args = args[1:]
+	newline := true
+	if len(args) > 0 && args[0] == "-n" {
+		newline = false
+		args = args[1:]
+	}
+
+	s := strings.Join(args, " ")
+	if newline {
+		s += "\n"
+	}
+	if _, err := fmt.Fprint(ca.Sh.Out, s); err != nil {
+		return 1, fmt.Errorf("echo: %w", err)
+	}
+	return 0, nil
+}
+
+// cd [dir|-]
+// dirを省略すると$HOME、-なら$OLDPWDに移動する
+// 移動できたら$PWDと$OLDPWDを更新する
+func Cd(ca *CmdArg, args []string) (int, error) {
+	dir := ca.Sh.Get("HOME")
+	if len(args) > 1 {
+		dir = args[1]
+	}
+	back := dir == "-"
+	if back {
+		dir = ca.Sh.Get("OLDPWD")
+		if dir == "" {
+			return 1, fmt.Errorf("cd: OLDPWD not set")
+		}
+	}
+	if dir == "" {
+		return 1, fmt.Errorf("cd: HOME not set")
+	}
+
+	// プロセスのカレントディレクトリは変えずに、シェルのDirだけを変える
+	old := ca.Sh.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(old, dir)
+	}
+	dir = filepath.Clean(dir)
+
+	if err := checkDir(dir); err != nil {
+		return 1, fmt.Errorf("cd: %s: %w", args[len(args)-1], err)
+	}
+	ca.Sh.Dir = dir
+	if err := ca.Sh.Export("OLDPWD", old); err != nil {
+		return 1, fmt.Errorf("cd: %w", err)
+	}
+	if err := ca.Sh.Export("PWD", dir); err != nil {
+		return 1, fmt.Errorf("cd: %w", err)
+	}
+	if back {
+		fmt.Fprintln(ca.Sh.Out, dir)
+	}
+	return 0, nil
+}
+
+// dirに移動できるか (ディレクトリで、実行権限があるか)
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.Unwrap(err)
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if err := syscall.Access(dir, accessExec); err != nil {
+		return err
+	}
+	return nil
+}
+
+// pwd
+func Pwd(ca *CmdArg, args []string) (int, error) {
+	fmt.Fprintln(ca.Sh.Out, ca.Sh.Dir)
+	return 0, nil
+}
+
+// enable [-a] [-n] [name...]
+// 組み込みコマンドを有効にする。-nなら無効にして、同じ名前の外部コマンドを使うようにする
+// nameがなければ有効な組み込みコマンド (-nなら無効なもの、-aなら全部) を一覧表示する
+func Enable(ca *CmdArg, args []string) (int, error) {
+	var all, disable bool
+	i := 1
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, c := range args[i][1:] {
+			switch c {
+			case 'a':
+				all = true
+			case 'n':
+				disable = true
+			default:
+				return 2, fmt.Errorf("enable: -%c: invalid option", c)
+			}
+		}
+	}
+
+	if i == len(args) {
+		var names []string
+		for name := range builtins {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			off := ca.Sh.Disabled[name]
+			if !all && off != disable {
+				continue
+			}
+			if off {
+				fmt.Fprintf(ca.Sh.Out, "enable -n %s\n", name)
+			} else {
+				fmt.Fprintf(ca.Sh.Out, "enable %s\n", name)
+			}
+		}
+		return 0, nil
+	}
+
+	status := 0
+	for _, name := range args[i:] {
+		if _, ok := builtins[name]; !ok {
+			ca.Sh.Error(fmt.Errorf("enable: %s: not a shell builtin", name))
+			status = 1
+			continue
+		}
+		if disable {
+			ca.Sh.Disabled[name] = true
+		} else {
+			delete(ca.Sh.Disabled, name)
+		}
+	}
+	return status, nil
+}
+
+// env [-i] [-u name] [name=value...] [command [args...]]
+// 環境変数を変更してcommandを外部コマンドとして実行する。シェルの変数は変わらない
+// commandがなければ環境変数を表示する。-iなら空の環境から始める
+func Env(ca *CmdArg, args []string) (int, error) {
+	env := ca.Sh.Environ()
+	i := 1
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		switch args[i] {
+		case "-i":
+			env = nil
+		case "-u":
+			if i+1 >= len(args) {
+				return 125, fmt.Errorf("env: -u: option requires an argument")
+			}
+			i++
+			env = removeEnv(env, args[i])
+		default:
+			return 125, fmt.Errorf("env: %s: invalid option", args[i])
+		}
+	}
+	for ; i < len(args) && strings.Contains(args[i], "="); i++ {
+		name, _, _ := strings.Cut(args[i], "=")
+		env = append(removeEnv(env, name), args[i])
+	}
+
+	if i == len(args) {
+		for _, kv := range env {
+			fmt.Fprintln(ca.Sh.Out, kv)
+		}
+		return 0, nil
+	}
+	ca.Cmd = args[i:]
+	ca.Attr.Env = env
+	return ca.RunExternal()
+}
+
+// envからnameの環境変数を取り除く
+func removeEnv(env []string, name string) []string {
+	var out []string
+	for _, kv := range env {
+		if n, _, _ := strings.Cut(kv, "="); n != name {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// printenv [name...]
+// 子プロセスに渡す環境変数を表示する。nameがあればその値だけを表示する
+// 環境変数でないnameがあれば1を返す
+func Printenv(ca *CmdArg, args []string) (int, error) {
+	env := ca.Sh.Environ()
+	if len(args) == 1 {
+		for _, kv := range env {
+			fmt.Fprintln(ca.Sh.Out, kv)
+		}
+		return 0, nil
+	}
+
+	status := 0
+	for _, name := range args[1:] {
+		found := false
+		for _, kv := range env {
+			if n, v, _ := strings.Cut(kv, "="); n == name {
+				fmt.Fprintln(ca.Sh.Out, v)
+				found = true
+				break
+			}
+		}
+		if !found {
+			status = 1
+		}
+	}
+	return status, nil
+}
+
+// source file [args...] / . file [args...]
+// fileを現在のシェルで実行する。argsがあれば実行中だけ位置パラメータにする
+func Source(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 2 {
+		return 2, fmt.Errorf("%s: filename argument required", args[0])
+	}
+	if len(args) > 2 {
+		saved := ca.Sh.Args
+		ca.Sh.Args = args[2:]
+		defer func() { ca.Sh.Args = saved }()
+	}
+
+	status, err := ca.SourceFile(args[1])
+	if err != nil && !IsControl(err) {
+		return 1, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return status, err
+}
+
+// builtin name [args...]
+// nameを組み込みコマンドとしてだけ探して実行する
+func RunBuiltin(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 2 {
+		return 0, nil
+	}
+	if _, ok := ca.Sh.Builtin(args[1]); !ok {
+		return 1, fmt.Errorf("builtin: %s: not a shell builtin", args[1])
+	}
+
+	ca.Cmd = args[1:]
+	return ca.Dispatch(true)
+}
+
+// command -pで使うPATH
+const defaultPath = "/usr/bin:/bin:/usr/sbin:/sbin"
+
+// command [-pvV] name [args...]
+// 関数を使わずに組み込みコマンドか外部コマンドを実行する
+// -v, -Vならnameがどう解決されるかを表示する
+func Command(ca *CmdArg, args []string) (int, error) {
+	var usePath, show, verbose bool
+	i := 1
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, c := range args[i][1:] {
+			switch c {
+			case 'p':
+				usePath = true
+			case 'v':
+				show = true
+			case 'V':
+				show, verbose = true, true
+			default:
+				return 2, fmt.Errorf("command: -%c: invalid option", c)
+			}
+		}
+	}
+	args = args[i:]
+	if len(args) == 0 {
+		return 0, nil
+	}
+
+	path := ca.Sh.Get("PATH")
+	if usePath {
+		path = defaultPath
+	}
+
+	if show {
+		status := 0
+		for _, name := range args {
+			desc, ok := ca.Sh.Describe(name, path, verbose)
+			if !ok {
+				status = 1
+				if verbose {
+					ca.Sh.Error(fmt.Errorf("command: %s: not found", name))
+				}
+				continue
+			}
+			fmt.Fprintln(ca.Sh.Out, desc)
+		}
+		return status, nil
+	}
+
+	ca.Cmd = args
+	if _, ok := ca.Sh.Builtin(args[0]); !ok && usePath {
+		p, err := LookPathIn(args[0], path, ca.Sh.Dir)
+		if err != nil {
+			return 127, err
+		}
+		ca.Cmd = append([]string{p}, args[1:]...)
+	}
+	return ca.Dispatch(true)
+}
+
+// nameが組み込みコマンド、関数、外部コマンドのどれになるかを返す
+// verboseでなければ外部コマンドはパスだけを返す
+func (sh *Shell) Describe(name, path string, verbose bool) (string, bool) {
+	if _, ok := sh.Builtin(name); ok {
+		if verbose {
+			return name + " is a shell builtin", true
+		}
+		return name, true
+	}
+	if _, ok := sh.Funcs[name]; ok {
+		if verbose {
+			return name + " is a function", true
+		}
+		return name, true
+	}
+	p, err := LookPathIn(name, path, sh.Dir)
+	if err != nil {
+		return "", false
+	}
+	if verbose {
+		return name + " is " + p, true
+	}
+	return p, true
+}
+
+// pathからnameの実行ファイルを探す
+// 相対パスはcwdからのパスとして調べ、見つけたパスは相対パスのまま返す
+func LookPathIn(name, path, cwd string) (string, error) {
+	if strings.Contains(name, "/") {
+		if err := checkExecutable(joinDir(cwd, name)); err != nil {
+			return "", &exec.Error{Name: name, Err: err}
+		}
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		p := filepath.Join(dir, name)
+		if checkExecutable(joinDir(cwd, p)) == nil {
+			return p, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// pが実行できるファイルか
+func checkExecutable(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return syscall.EISDIR
+	}
+	if fi.Mode()&0111 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// umask [-S] [mode]
+// modeは8進数。省略すると現在の値を表示する (-Sなら記号で表示)
+func Umask(ca *CmdArg, args []string) (int, error) {
+	symbolic := false
+	args = args[1:]
+	if len(args) > 0 && args[0] == "-S" {
+		symbolic = true
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		mask := ca.Sh.Umask
+		if symbolic {
+			fmt.Fprintln(ca.Sh.Out, SymbolicMode(^mask&0777))
+		} else {
+			fmt.Fprintf(ca.Sh.Out, "%04o\n", mask)
+		}
+		return 0, nil
+	}
+
+	mask, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mask > 0777 {
+		return 1, fmt.Errorf("umask: %s: octal number out of range", args[0])
+	}
+	ca.Sh.Umask = int(mask)
+	return 0, nil
+}
+
+// times
+// シェルと子プロセスが使ったユーザー時間とシステム時間を1行ずつ表示する
+func Times(ca *CmdArg, args []string) (int, error) {
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			return 1, fmt.Errorf("times: %w", err)
+		}
+		fmt.Fprintf(ca.Sh.Out, "%s %s\n", formatTimeval(ru.Utime), formatTimeval(ru.Stime))
+	}
+	return 0, nil
+}
+
+// 0m0.010sの形にする
+func formatTimeval(tv syscall.Timeval) string {
+	ms := int64(tv.Sec)*1000 + int64(tv.Usec)/1000
+	return fmt.Sprintf("%dm%d.%03ds", ms/60000, ms/1000%60, ms%1000)
+}
+
+// パーミッションをu=rwx,g=rx,o=rxの形式にする
+func SymbolicMode(perm int) string {
+	var parts []string
+	for i, who := range []string{"u", "g", "o"} {
+		bits := perm >> uint(3*(2-i)) & 7
+		s := who + "="
+		for j, c := range "rwx" {
+			if bits&(4>>uint(j)) != 0 {
+				s += string(c)
+			}
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ",")
+}
+
+// getopts optstring name [args...]
+// 位置パラメータ (argsがあればargs) からオプションを1つ読んでnameに入れる
+// 引数を取るオプションの引数は$OPTARGに、次に読む引数の番号は$OPTINDに入る
+// オプションがなくなったら1を返す
+func Getopts(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 3 {
+		return 2, fmt.Errorf("getopts: usage: getopts optstring name [arg ...]")
+	}
+	optstring, name := args[1], args[2]
+	if !IsName(name) {
+		return 1, fmt.Errorf("getopts: `%s': not a valid identifier", name)
+	}
+	params := ca.Sh.Args
+	if len(args) > 3 {
+		params = args[3:]
+	}
+	silent := strings.HasPrefix(optstring, ":")
+
+	sh := ca.Sh
+	optind, err := strconv.Atoi(sh.Get("OPTIND"))
+	if err != nil || optind < 1 {
+		optind = 1
+	}
+	// OPTINDか引数が変わったら、読みかけの引数の続きではなく次の引数から読む
+	if optind != sh.optind || !slices.Equal(params, sh.optparams) ||
+		optind > len(params) || sh.optchar >= len(params[optind-1]) {
+		sh.optchar = 0
+	}
+	// 変数への代入はSetVarで行う (readonlyや-iの属性に従う)
+	// hasArgなら$OPTARGにoptargを入れ、そうでなければ$OPTARGを消す
+	result := func(status int, value, optarg string, hasArg bool) (int, error) {
+		sh.optind = optind
+		sh.optparams = append([]string{}, params...)
+		if err := sh.SetVar("OPTIND", strconv.Itoa(optind)); err != nil {
+			return 1, fmt.Errorf("getopts: %v", err)
+		}
+		if hasArg {
+			if err := sh.SetVar("OPTARG", optarg); err != nil {
+				return 1, fmt.Errorf("getopts: %v", err)
+			}
+		} else if !sh.Readonly["OPTARG"] {
+			delete(sh.Vars, "OPTARG")
+		}
+		if err := sh.SetVar(name, value); err != nil {
+			return 1, fmt.Errorf("getopts: %v", err)
+		}
+		return status, nil
+	}
+
+	// 次の引数を読む
+	if sh.optchar == 0 {
+		if optind > len(params) {
+			return result(1, "?", "", false)
+		}
+		a := params[optind-1]
+		if a == "--" {
+			optind++
+			return result(1, "?", "", false)
+		}
+		if len(a) < 2 || a[0] != '-' {
+			return result(1, "?", "", false)
+		}
+		sh.optchar = 1
+	}
+
+	// -abcのようにまとめて書かれたオプションは1文字ずつ読む
+	a := params[optind-1]
+	c := a[sh.optchar]
+	sh.optchar++
+	if sh.optchar >= len(a) {
+		optind++
+		sh.optchar = 0
+	}
+
+	i := strings.IndexByte(optstring, c)
+	if i < 0 || c == ':' {
+		if silent {
+			return result(0, "?", string(c), true)
+		}
+		sh.Error(fmt.Errorf("getopts: illegal option -- %c", c))
+		return result(0, "?", "", false)
+	}
+
+	// 引数を取るオプション
+	if i+1 < len(optstring) && optstring[i+1] == ':' {
+		switch {
+		case sh.optchar != 0:
+			optarg := a[sh.optchar:]
+			optind++
+			sh.optchar = 0
+			return result(0, string(c), optarg, true)
+		case optind <= len(params):
+			optarg := params[optind-1]
+			optind++
+			return result(0, string(c), optarg, true)
+		case silent:
+			return result(0, ":", string(c), true)
+		default:
+			sh.Error(fmt.Errorf("getopts: option requires an argument -- %c", c))
+			return result(0, "?", "", false)
+		}
+	}
+	return result(0, string(c), "", false)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestGetopts(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"options", `for i in 1 2 3; do getopts "ab" o -a -b x; echo $? $o $OPTIND; done`, "0 a 2\n0 b 3\n1 ? 3\n"},
+		{"grouped", `for i in 1 2 3; do getopts "abc" o -ab -c; echo $o; done`, "a\nb\nc\n"},
+		{"argument", `getopts "a:" o -a foo; echo $o $OPTARG $OPTIND`, "a foo 3\n"},
+		{"attached argument", `getopts "a:" o -afoo; echo $o $OPTARG $OPTIND`, "a foo 2\n"},
+		{"empty argument", `getopts "a:" o -a ""; echo "$o[$OPTARG]" ${OPTARG+set}`, "a[] set\n"},
+		{"double dash", `getopts "a" o -- -a; echo $? $o $OPTIND`, "1 ? 2\n"},
+		{"non option", `getopts "a" o x -a; echo $? $o $OPTIND`, "1 ? 1\n"},
+		{"unset optarg at end", `getopts "a:" o -a x; getopts "a:" o -a x; echo $? ${OPTARG-unset}`, "1 unset\n"},
+		{"silent illegal", `getopts ":a" o -x; echo $o $OPTARG`, "? x\n"},
+		{"silent missing argument", `getopts ":a:" o -a; echo $o $OPTARG`, ": a\n"},
+		{"integer name", `declare -i n; getopts "a" n -a; echo $n`, "0\n"},
+		{"unquoted optstring", `getopts ab: o -b x; echo $o $OPTARG`, "b x\n"},
+		{"unquoted silent", `getopts :a o -z; echo $o $OPTARG`, "? z\n"},
+		{"unquoted silent missing argument", `getopts :a: o -a; echo $o $OPTARG`, ": a\n"},
+		{"reset optind", `getopts ab: o -b x; OPTIND=1; getopts :a o -a; echo $o $OPTIND`, "a 2\n"},
+		{"positional parameters", `f() { getopts a: o; echo $o $OPTARG; }; f -a 1`, "a 1\n"},
+		{"arguments changed", `getopts ab o -ab; getopts ab o x; echo $? $o $OPTIND`, "1 ? 1\n"},
+		{"arguments changed to options", `getopts ab o -ab; getopts ab o -b; echo $o $OPTIND`, "b 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%s: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestGetoptsErrors(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"illegal option", `getopts "a" o -x; echo $o ${OPTARG-unset}`, "? unset\n", "illegal option -- x"},
+		{"missing argument", `getopts "a:" o -a; echo $o`, "?\n", "option requires an argument -- a"},
+		{"readonly name", `readonly o; getopts "ab" o -a; echo $? "[$o]"`, "1 []\n", "o: readonly variable"},
+		{"readonly optind", `readonly OPTIND; getopts "a" o -a; echo $?`, "1\n", "OPTIND: readonly variable"},
+		{"invalid name", `getopts "a" 1x -a; echo $?`, "1\n", "not a valid identifier"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%s: got %q, want %q", tt.src, out, tt.out)
+			}
+			if !strings.Contains(errOut, tt.err) {
+				t.Errorf("%s: stderr %q does not contain %q", tt.src, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+		status         int
+	}{
+		{"status", `echo a; exit 3; echo b`, "a\n", 3},
+		{"last status", `sh -c 'exit 4'; exit`, "", 4},
+		{"wraps", `exit 257`, "", 1},
+		{"in function", `f() { exit 5; }; f; echo no`, "", 5},
+		{"in loop", `for i in 1 2; do exit $i; done`, "", 1},
+		{"in eval", `eval exit 6; echo no`, "", 6},
+		{"subshell", `( exit 7 ); echo $?`, "7\n", 0},
+		{"pipeline stage", `exit 8 | cat; echo ${PIPESTATUS[@]}`, "8 0\n", 0},
+		{"too many arguments", `exit 1 2; echo $?`, "1\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, status := runShell(t, tt.src)
+			if out != tt.out || status != tt.status {
+				t.Errorf("%q: got %q, status %d, want %q, status %d", tt.src, out, status, tt.out, tt.status)
+			}
+		})
+	}
+
+	out, errOut, status := runShell(t, `exit abc; echo no`)
+	if out != "" || status != 2 || !strings.Contains(errOut, "numeric argument required") {
+		t.Errorf("exit abc: got %q, status %d (stderr %q)", out, status, errOut)
+	}
+	if out, _, status := runMain(t, "echo a\nexit 9\necho b\n"); out != "a\n" || status != 9 {
+		t.Errorf("script: got %q, status %d, want \"a\\n\", status 9", out, status)
+	}
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+		status         int
+	}{
+		{"open and close fd 3", `exec 3> f; echo a >&3; sh -c 'echo b >&3'; exec 3>&-; echo c >&3; echo $?; sh -c 'echo d >&3' 2>/dev/null; [ $? -ne 0 ]; echo $?; cat f`, "1\n0\na\nb\n", 0},
+		{"read fd", `echo x > f; exec 4< f; read v <&4; echo $v; exec 4<&-`, "x\n", 0},
+		{"dup stdout", `exec 3>&1; echo a >&3`, "a\n", 0},
+		{"save and restore stdout", `exec 5>&1; exec > f; echo a; exec 1>&5 5>&-; echo b; cat f`, "b\na\n", 0},
+		{"group redirect", `{ echo a >&3; } 3> f; echo b >&3; echo $?; cat f`, "1\na\n", 0},
+		{"subshell", `( exec 3> f; echo a >&3 ); echo b >&3; echo $?; cat f`, "1\na\n", 0},
+		{"process substitution", `exec 3> f; cat <(echo p); exec 3>&-`, "p\n", 0},
+		{"digit inside word", `echo a2>f; cat f`, "a2\n", 0},
+		{"two-digit fd", `exec 10> f; echo a >&10; sh -c 'echo b >> /dev/fd/10'; exec 10>&-; echo c >&10; echo $?; cat f`, "1\na\nb\n", 0},
+		{"two-digit fd on a command", `echo a 12> f >&12; cat f`, "a\n", 0},
+		{"command", `exec echo hi; echo no`, "hi\n", 0},
+		{"command status", `exec sh -c 'exit 3'; echo no`, "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "cd " + t.TempDir() + "; " + tt.src
+			out, _, status := runShell(t, src)
+			if out != tt.out || status != tt.status {
+				t.Errorf("%q: got %q, status %d, want %q, status %d", tt.src, out, status, tt.out, tt.status)
+			}
+		})
+	}
+
+	errs := []struct {
+		name, src, err string
+	}{
+		{"closed fd 3", `exec 3>&-; echo a >&3`, "3: bad file descriptor"},
+		{"closed stdout", `echo a >&-`, "echo: write error: bad file descriptor"},
+		{"closed stdin", `read v <&-`, "read: read error: bad file descriptor"},
+		{"exec closed stdout", `exec >&-; echo a`, "echo: write error: bad file descriptor"},
+		{"fd too large", `exec 99999> f`, "99999: bad file descriptor"},
+	}
+	for _, tt := range errs {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src+"; echo $? >&2")
+			if out != "" || !strings.Contains(errOut, tt.err) || !strings.HasSuffix(errOut, "\n1\n") || strings.Contains(errOut, os.DevNull) {
+				t.Errorf("%q: got %q (stderr %q), want status 1 and %q", tt.src, out, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"assigns", `eval "x=5"; echo $x`, "5\n"},
+		{"assigns built name", `n=y; eval "$n=7"; echo $y`, "7\n"},
+		{"joins arguments", `eval echo a   b`, "a b\n"},
+		{"list", `cmd='echo a; echo b'; eval $cmd`, "a\nb\n"},
+		{"pipeline", `eval 'echo a | tr a b'`, "b\n"},
+		{"defines function", `eval 'f() { echo fn; }'; f`, "fn\n"},
+		{"loop", `eval 'for i in 1 2; do echo $i; done'`, "1\n2\n"},
+		{"expands twice", `a='$b'; b=x; eval echo $a`, "x\n"},
+		{"status", `eval false; echo $?`, "1\n"},
+		{"empty", `eval; echo $?`, "0\n"},
+		{"nested", `eval "eval 'z=1'"; echo $z`, "1\n"},
+		{"in function", `f() { eval 'g=2'; }; f; echo $g`, "2\n"},
+		{"local in function", `g=1; f() { local g; eval 'g=2'; }; f; echo $g`, "1\n"},
+		{"syntax error", `eval 'for'; echo $?`, "2\n"},
+		{"nesting limit", `e='eval "$e"'; eval "$e"; echo $?`, "1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+
+	_, errOut, _ := runShell(t, `e='eval "$e"'; eval "$e"`)
+	if !strings.Contains(errOut, "maximum eval nesting level exceeded") {
+		t.Errorf("nesting limit: stderr %q", errOut)
+	}
+}
+
+func TestShift(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"default", `f() { shift; echo $# $@; }; f a b c`, "2 b c\n"},
+		{"count", `f() { shift 2; echo $# $1; }; f a b c`, "1 c\n"},
+		{"all", `f() { shift 3; echo $# "[$1]"; }; f a b c`, "0 []\n"},
+		{"zero", `f() { shift 0; echo $1; }; f a b`, "a\n"},
+		{"loop", `f() { for i in 1 2 3; do echo $1; shift; done; }; f x y z`, "x\ny\nz\n"},
+		{"out of range", `f() { shift 4; echo $? $# $1; }; f a b c`, "1 3 a\n"},
+		{"negative", `f() { shift -1; echo $? $#; }; f a`, "1 1\n"},
+		{"not a number", `f() { shift x; echo $? $#; }; f a`, "1 1\n"},
+		{"no parameters", `shift; echo $?`, "1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestEnable(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+		external       []string // 外部コマンドとして実行したコマンド
+	}{
+		{"builtin", `echo a`, "a\n", nil},
+		{"disabled", `enable -n echo; echo a`, "a\n", []string{"echo"}},
+		{"enabled again", `enable -n echo; enable echo; echo a`, "a\n", nil},
+		{"resolves to path", `enable -n echo; command -v echo | grep -c /echo`, "1\n", []string{"grep"}},
+		{"list disabled", `enable -n echo; enable -n pwd; enable -n`, "enable -n echo\nenable -n pwd\n", nil},
+		{"list hides disabled", `enable -n echo; enable | grep -c 'enable echo$'`, "0\n", []string{"grep"}},
+		{"list all", `enable -n echo; enable -a | grep 'enable.* echo$'`, "enable -n echo\n", []string{"grep"}},
+		{"builtin command", `enable -n echo; builtin echo a; printf '%s\n' $?`, "1\n", nil},
+		{"pipeline stage", `enable -n echo | true; echo a`, "a\n", []string{"true"}},
+		{"not a builtin", `enable nosuch; echo $?`, "1\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var external []string
+			out, _, _ := runShellSetup(t, tt.src, "", func(sh *Shell) {
+				sh.PreExec = func(cmd []string) (bool, error) {
+					external = append(external, cmd[0])
+					return true, nil
+				}
+			})
+			if out != tt.out || !slices.Equal(external, tt.external) {
+				t.Errorf("%q: got %q, external %q, want %q, external %q", tt.src, out, external, tt.out, tt.external)
+			}
+		})
+	}
+}
+
+func TestShopt(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"set", `shopt -s nullglob; shopt -q nullglob; echo $?`, "0\n"},
+		{"unset", `shopt -s pipefail; shopt -u pipefail; shopt -q pipefail; echo $?`, "1\n"},
+		{"query is silent", `shopt -q nullglob; echo $?`, "1\n"},
+		{"query several", `shopt -s nullglob pipefail; shopt -q nullglob pipefail; echo $?; shopt -q nullglob noclobber; echo $?`, "0\n1\n"},
+		{"shared with set -o", `set -o noclobber; shopt -q noclobber; echo $?; shopt -u noclobber; set -o | grep noclobber`, "0\nnoclobber      \toff\n"},
+		{"show one", `shopt -s pipefail; shopt pipefail`, "pipefail       \ton\n"},
+		{"show off status", `shopt pipefail; echo $?`, "pipefail       \toff\n1\n"},
+		{"list enabled", `shopt -s pipefail nullglob; shopt -s`, "nullglob       \ton\npipefail       \ton\n"},
+		{"list disabled", `shopt -u | grep -c off`, "8\n"},
+		{"list all", `shopt | wc -l`, "8\n"},
+		{"reusable", `shopt -s pipefail; shopt -p pipefail nullglob`, "shopt -s pipefail\nshopt -u nullglob\n"},
+		{"takes effect", `shopt -s nullglob; echo x *.none`, "x\n"},
+		{"exclusive", `shopt -s nullglob; shopt -s failglob; shopt -q nullglob; echo $?`, "1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestShoptErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+		status   string
+	}{
+		{`shopt -s nosuch`, "nosuch: invalid shell option name", "1"},
+		{`shopt -su pipefail`, "cannot set and unset shell options simultaneously", "1"},
+		{`shopt -x`, "-x: invalid option", "2"},
+	}
+	for _, tt := range tests {
+		out, errOut, _ := runShell(t, tt.src+"; echo $?")
+		if out != tt.status+"\n" || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q (stderr %q), want status %s and %q", tt.src, out, errOut, tt.status, tt.err)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"restore", `x=1; f() { local x=2; echo $x; }; f; echo $x`, "2\n1\n"},
+		{"unset inside", `x=1; f() { local x; echo "[$x]"; }; f; echo $x`, "[]\n1\n"},
+		{"integer", `f() { declare -i n; local n=1+2; echo $n; }; f`, "3\n"},
+		{"readonly", `readonly x=1; f() { local x=2; echo $? $x; }; f`, "1 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%s: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello"), []byte("#!/bin/sh\necho hello\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"shell PATH", `PATH=` + dir + `; command -v hello`, dir + "/hello\n"},
+		{"shell PATH not exported", `PATH=/nonexistent; command -v ls; echo $?`, "1\n"},
+		{"default path", `PATH=/nonexistent; command -p -v sh`, "/usr/bin/sh\n"},
+		{"run with default path", `PATH=/nonexistent; command -p sh -c 'echo ok'`, "ok\n"},
+		{"builtin", `command -v echo; command -V echo`, "echo\necho is a shell builtin\n"},
+		{"function", `f() { echo f; }; command -v f; command -V f`, "f\nf is a function\n"},
+		{"run external", `PATH=` + dir + `; command hello`, "hello\n"},
+		{"skip function", `echo() { printf 'f\n'; }; command echo builtin`, "builtin\n"},
+		{"no arguments", `command; echo $?`, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestCd(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte("data\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"pwd", `cd ` + dir + `; pwd; echo $PWD`, dir + "\n" + dir + "\n"},
+		{"oldpwd", `cd ` + dir + `; echo $OLDPWD`, wd + "\n"},
+		{"dash", `cd ` + dir + `; cd / ; cd -; pwd`, dir + "\n" + dir + "\n"},
+		{"pipeline stage", `cd / | true; pwd`, wd + "\n"},
+		{"subshell", `( cd / ); pwd`, wd + "\n"},
+		{"external command", `cd ` + dir + `; /bin/pwd`, dir + "\n"},
+		{"relative redirect", `cd ` + dir + `; cat < f.txt`, "data\n"},
+		{"relative glob", `cd ` + dir + `; echo *.txt`, "f.txt\n"},
+		{"file test", `cd ` + dir + `; test -f f.txt; echo $?`, "0\n"},
+		{"cond file test", `cd ` + dir + `; [[ -f f.txt ]]; echo $?`, "0\n"},
+		{"relative cd", `cd ` + dir + `; cd ..; pwd`, filepath.Dir(dir) + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("process directory changed to %q", got)
+	}
+}
+
+func TestCdErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, src, err string
+	}{
+		{"missing", `cd ` + dir + `/nonexistent`, "no such file or directory"},
+		{"not a directory", `cd ` + dir + `/f.txt`, "not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src+"; echo $?; pwd")
+			wd, _ := os.Getwd()
+			if out != "1\n"+wd+"\n" || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want status 1 and %q", tt.src, out, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestUmask(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, src, out string
+	}{
+		{"set", `umask 077; umask`, "0077\n"},
+		{"pipeline stage", `umask 022; umask 077 | true; umask`, "0022\n"},
+		{"subshell", `umask 022; ( umask 077 ); umask`, "0022\n"},
+		{"external command", `umask 027; sh -c umask`, "0027\n"},
+		{"redirect", `umask 077; echo x > ` + dir + `/f; stat -c %a ` + dir + `/f`, "600\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestTimes(t *testing.T) {
+	out, errOut, status := runShell(t, `true; times`)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if status != 0 || errOut != "" || len(lines) != 2 {
+		t.Fatalf("got %q, status %d (stderr %q), want two lines", out, status, errOut)
+	}
+	re := regexp.MustCompile(`^[0-9]+m[0-9]+\.[0-9]{3}s$`)
+	for _, l := range lines {
+		f := strings.Fields(l)
+		if len(f) != 2 || !re.MatchString(f[0]) || !re.MatchString(f[1]) {
+			t.Errorf("line %q: want two times like 0m0.010s", l)
+		}
+	}
+}
+
+func TestFormatTimeval(t *testing.T) {
+	tests := []struct {
+		tv   syscall.Timeval
+		want string
+	}{
+		{syscall.Timeval{}, "0m0.000s"},
+		{syscall.Timeval{Usec: 10000}, "0m0.010s"},
+		{syscall.Timeval{Sec: 1, Usec: 999999}, "0m1.999s"},
+		{syscall.Timeval{Sec: 59, Usec: 500000}, "0m59.500s"},
+		{syscall.Timeval{Sec: 125, Usec: 3000}, "2m5.003s"},
+	}
+	for _, tt := range tests {
+		if got := formatTimeval(tt.tv); got != tt.want {
+			t.Errorf("formatTimeval(%+v) = %q, want %q", tt.tv, got, tt.want)
+		}
+	}
+}
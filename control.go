@@ -0,0 +1,846 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+	for文などの複合コマンドの構文解析と実行
+*/
+// 入力が途中で終わっている (for文が閉じていないなど)
+var ErrIncomplete = errors.New("syntax error: unexpected end of input")
+
+// 構文木のノード
+type Node interface{}
+
+// 3項間演算子やパイプを含むコマンド
+type SimpleNode struct {
+	Args []Token
+	Cmd  *CmdTree // Argsを3項間演算子とパイプで分けたもの
+	Line int      // スクリプトの行番号
+}
+
+// for Name in Words; do Body; done Redirects
+type ForNode struct {
+	Name      string
+	Words     []string
+	Body      []Node
+	Redirects []Token // ループ全体に適用するリダイレクト
+	Line      int
+}
+
+// for (( Init; Cond; Update )); do Body; done Redirects
+type ArithForNode struct {
+	Init, Cond, Update string // 算術式
+	Body               []Node
+	Redirects          []Token // ループ全体に適用するリダイレクト
+	Line               int
+}
+
+// { Body } Redirectsか( Body ) Redirects
+type GroupNode struct {
+	Body      []Node
+	Redirects []Token // グループ全体に適用するリダイレクト
+	Subshell  bool    // ( Body )ならシェルのコピーで実行する
+	Line      int
+}
+
+// { }や( )、for文を含むパイプ (A | { B; } | ( C ) | for ...; done)
+// 各段はSimpleNodeかGroupNode、ForNode、ArithForNodeで、シェルのコピーの中で同時に実行する
+type PipeNode struct {
+	Stages []Node
+	Line   int
+}
+
+// name() { Body }
+type FuncNode struct {
+	Name string
+	Body []Node
+}
+
+// コマンドの先頭に来たときだけ予約語として扱う
+var reserved = map[string]bool{
+	"do":   true,
+	"done": true,
+	"{":    true,
+	"}":    true,
+}
+
+// 構文エラー
+type SyntaxError struct {
+	Line int
+	Msg  string
+	Tok  int // エラーになったトークンの位置 (ParseListに渡したトークン列の添字、不明なら-1)
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+type parser struct {
+	toks      []Token
+	pos       int
+	line      int // 現在のトークンの行番号
+	subshells int // 読んでいる( )の深さ
+}
+
+// コマンドの区切り (;か改行)
+func isSep(tok Token) bool {
+	return tok.Kind == NewlineToken || tok.Is(OperatorToken, ";")
+}
+
+// トークン列をコマンドの列にパースする
+// lineは最初の行の行番号
+func ParseList(toks []Token, line int) ([]Node, error) {
+	p := parser{toks: toks, line: line}
+	nodes, err := p.parseList()
+	if err == nil {
+		debugNodes(nodes, 0)
+	}
+	return nodes, err
+}
+
+// 現在のトークン (末尾なら空のトークン)
+func (p *parser) peek() Token {
+	return p.peekAt(0)
+}
+
+// k個先のトークン
+func (p *parser) peekAt(k int) Token {
+	if p.pos+k >= len(p.toks) {
+		return Token{}
+	}
+	return p.toks[p.pos+k]
+}
+
+// 現在のトークンが予約語wordか
+func (p *parser) word(word string) bool {
+	return p.peek().Is(WordToken, word)
+}
+
+// 現在のトークンが演算子opか
+func (p *parser) op(op string) bool {
+	return p.peek().Is(OperatorToken, op)
+}
+
+// 現在のトークンが( )の中を閉じる)か
+func (p *parser) closeSubshell() bool {
+	return p.op(")") && p.subshells > 0
+}
+
+// ;と改行を読み飛ばす
+func (p *parser) skipSep() {
+	for isSep(p.peek()) {
+		if p.peek().Kind == NewlineToken {
+			p.line++
+		}
+		p.pos++
+	}
+}
+
+// endsのどれかのトークンが来るまでコマンドを読む
+// endsが空なら入力の末尾まで読む
+func (p *parser) parseList(ends ...Token) ([]Node, error) {
+	var nodes []Node
+	for {
+		p.skipSep()
+		if p.pos >= len(p.toks) {
+			if len(ends) > 0 {
+				return nil, ErrIncomplete
+			}
+			return nodes, nil
+		}
+		for _, e := range ends {
+			if p.peek().Is(e.Kind, e.Text) {
+				return nodes, nil
+			}
+		}
+
+		n, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+// コマンドを1つ読む
+func (p *parser) parseCommand() (Node, error) {
+	tok := p.peek()
+	if tok.Kind == WordToken && IsName(tok.Text) && p.peekAt(1).Is(OperatorToken, "(") && p.peekAt(2).Is(OperatorToken, ")") {
+		return p.parseFunc()
+	}
+	if (tok.Kind == WordToken && reserved[tok.Text] && tok.Text != "{") || p.closeSubshell() {
+		return nil, p.unexpected()
+	}
+	return p.parsePipeline()
+}
+
+// パイプでつながったコマンドを読む
+// { }や( )、for文がなければ全体を1つのSimpleNodeにする (パイプはParseCmdTreeで分ける)
+func (p *parser) parsePipeline() (Node, error) {
+	line := p.line
+	var stages []Node
+	for {
+		var n Node
+		var err error
+		switch {
+		case p.word("for"):
+			n, err = p.parseFor()
+		case p.word("{") || p.op("("):
+			n, err = p.parseGroup()
+		default:
+			n, err = p.parseSimple()
+		}
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, n)
+		if !p.op("|") {
+			break
+		}
+		if err := p.pipeNext(); err != nil {
+			return nil, err
+		}
+	}
+	if len(stages) == 1 {
+		return stages[0], nil
+	}
+
+	// SimpleNodeの中のパイプも段に分ける
+	pn := &PipeNode{Line: line}
+	for _, n := range stages {
+		sn, ok := n.(*SimpleNode)
+		if !ok {
+			pn.Stages = append(pn.Stages, n)
+			continue
+		}
+		// 3項間演算子は{ }や( )を含むパイプの中では使えない
+		for _, t := range sn.Args {
+			if t.Is(OperatorToken, "?") {
+				return nil, &SyntaxError{sn.Line, "syntax error near unexpected token `?'", -1}
+			}
+		}
+		for _, args := range sn.Cmd.Stages {
+			pn.Stages = append(pn.Stages, &SimpleNode{Args: args, Cmd: ParseCmdTree(args), Line: sn.Line})
+		}
+	}
+	return pn, nil
+}
+
+// ;か改行までを1つのコマンドとして読む
+// ( )の中では、対応する(のない)でも終わる。( )の外では構文エラーにする
+// 次に{ }か( )、for文が来る|でも終わる (A | { B; })
+// |の前後が空のときは構文エラーにする。行末の|の後は次の行に続く
+func (p *parser) parseSimple() (*SimpleNode, error) {
+	n := &SimpleNode{Line: p.line}
+	depth := 0
+	cond := false // [[ ]]の中
+	for p.pos < len(p.toks) && !isSep(p.peek()) {
+		switch {
+		case p.word("[[") && !cond:
+			cond = true
+		case p.word("]]") && cond:
+			cond = false
+		case cond:
+		case p.op("("):
+			depth++
+		case p.op(")"):
+			if depth == 0 && p.subshells > 0 {
+				n.Cmd = ParseCmdTree(n.Args)
+				return n, nil
+			}
+			// 対応する(のない)
+			if depth == 0 {
+				return nil, p.unexpected()
+			}
+			depth--
+		case p.op("|"):
+			if len(n.Args) == 0 {
+				return nil, p.unexpected()
+			}
+			if depth == 0 && (p.peekAt(1).Is(WordToken, "{") || p.peekAt(1).Is(OperatorToken, "(") || p.peekAt(1).Is(WordToken, "for")) {
+				n.Cmd = ParseCmdTree(n.Args)
+				return n, nil
+			}
+			n.Args = append(n.Args, p.peek())
+			if err := p.pipeNext(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n.Args = append(n.Args, p.peek())
+		p.pos++
+	}
+	n.Cmd = ParseCmdTree(n.Args)
+	return n, nil
+}
+
+// |を読み飛ばし、その後にコマンドがあるか調べる
+// 改行は読み飛ばして次の行のコマンドにつなぐ
+func (p *parser) pipeNext() error {
+	p.pos++
+	for p.peek().Kind == NewlineToken {
+		p.line++
+		p.pos++
+	}
+	if p.pos >= len(p.toks) {
+		return ErrIncomplete
+	}
+	if isSep(p.peek()) || p.op("|") || p.closeSubshell() {
+		return p.unexpected()
+	}
+	return nil
+}
+
+// for Name in Words; do Body; done Redirects
+func (p *parser) parseFor() (Node, error) {
+	p.pos++
+	if p.pos >= len(p.toks) {
+		return nil, ErrIncomplete
+	}
+	if p.op("(") && p.peekAt(1).Is(OperatorToken, "(") && p.peek().End == p.peekAt(1).Start {
+		return p.parseArithFor()
+	}
+	n := &ForNode{Name: p.peek().Text, Line: p.line}
+	if !IsName(n.Name) {
+		return nil, &SyntaxError{p.line, fmt.Sprintf("`%s': not a valid identifier", n.Name), p.index()}
+	}
+	p.pos++
+
+	// 単語リスト
+	if !p.word("in") {
+		return nil, p.unexpected()
+	}
+	p.pos++
+	for p.pos < len(p.toks) && !isSep(p.peek()) {
+		n.Words = append(n.Words, p.peek().Text)
+		p.pos++
+	}
+
+	body, err := p.parseDoBody()
+	if err != nil {
+		return nil, err
+	}
+	n.Body = body
+	n.Redirects, err = p.parseRedirects()
+	return n, err
+}
+
+// for (( Init; Cond; Update )); do Body; done Redirects
+// (( ))の中は;で3つに分けて、トークンを元の空白を残してつなげる
+func (p *parser) parseArithFor() (Node, error) {
+	n := &ArithForNode{Line: p.line}
+	p.pos += 2
+
+	var exprs []string
+	var sb strings.Builder
+	prev := -1 // 前のトークンの終わりの位置 (行の始めなら-1)
+	depth := 0
+	for {
+		if p.pos >= len(p.toks) {
+			return nil, ErrIncomplete
+		}
+		t := p.peek()
+		if t.Is(OperatorToken, ")") && depth == 0 {
+			if !p.peekAt(1).Is(OperatorToken, ")") {
+				return nil, p.unexpected()
+			}
+			break
+		}
+		switch {
+		case t.Is(OperatorToken, "("):
+			depth++
+		case t.Is(OperatorToken, ")"):
+			depth--
+		case t.Is(OperatorToken, ";") && depth == 0:
+			exprs = append(exprs, sb.String())
+			sb.Reset()
+			prev = -1
+			p.pos++
+			continue
+		case t.Kind == NewlineToken:
+			p.line++
+			sb.WriteByte(' ')
+			prev = -1
+			p.pos++
+			continue
+		}
+		if prev >= 0 && t.Start != prev {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(t.Text)
+		prev = t.End
+		p.pos++
+	}
+	exprs = append(exprs, sb.String())
+	if len(exprs) != 3 {
+		return nil, &SyntaxError{p.line, "syntax error: arithmetic expression required", p.index()}
+	}
+	n.Init, n.Cond, n.Update = exprs[0], exprs[1], exprs[2]
+	p.pos += 2
+
+	// )) の後の;は省略できる
+	body, err := p.parseDoBody()
+	if err != nil {
+		return nil, err
+	}
+	n.Body = body
+	n.Redirects, err = p.parseRedirects()
+	return n, err
+}
+
+// do Body done
+func (p *parser) parseDoBody() ([]Node, error) {
+	p.skipSep()
+	if !p.word("do") {
+		return nil, p.unexpected()
+	}
+	p.pos++
+	body, err := p.parseList(Token{Text: "done", Kind: WordToken})
+	if err != nil {
+		return nil, err
+	}
+	p.pos++
+	return body, nil
+}
+
+// name() { Body }
+func (p *parser) parseFunc() (Node, error) {
+	n := &FuncNode{Name: p.peek().Text}
+	p.pos += 3
+
+	p.skipSep()
+	if !p.word("{") {
+		return nil, p.unexpected()
+	}
+	p.pos++
+	body, err := p.parseList(Token{Text: "}", Kind: WordToken})
+	if err != nil {
+		return nil, err
+	}
+	n.Body = body
+	p.pos++
+
+	return n, p.endCommand()
+}
+
+// { Body } Redirectsか( Body ) Redirects
+func (p *parser) parseGroup() (Node, error) {
+	n := &GroupNode{Subshell: p.op("("), Line: p.line}
+	p.pos++
+	end := Token{Text: "}", Kind: WordToken}
+	if n.Subshell {
+		end = Token{Text: ")", Kind: OperatorToken}
+		p.subshells++
+	}
+	body, err := p.parseList(end)
+	if n.Subshell {
+		p.subshells--
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.Body = body
+	p.pos++
+
+	n.Redirects, err = p.parseRedirects()
+	return n, err
+}
+
+// }や)、doneの後のリダイレクトを読む
+// その後にはリダイレクトとパイプだけを書ける
+func (p *parser) parseRedirects() ([]Token, error) {
+	if !p.atEnd() && !p.op("|") && p.peek().Kind != RedirectToken {
+		return nil, p.unexpected()
+	}
+	start := p.pos
+	for !p.atEnd() && !p.op("|") {
+		p.pos++
+	}
+	return p.toks[start:p.pos], nil
+}
+
+// 複合コマンドの後には;か改行か入力の末尾が来る
+func (p *parser) endCommand() error {
+	if !p.atEnd() {
+		return p.unexpected()
+	}
+	return nil
+}
+
+// コマンドの終わりか (;、改行、入力の末尾、( )の中なら))
+func (p *parser) atEnd() bool {
+	return p.pos >= len(p.toks) || isSep(p.peek()) || p.closeSubshell()
+}
+
+// 現在のトークンについての構文エラー
+func (p *parser) unexpected() error {
+	if p.pos >= len(p.toks) {
+		return ErrIncomplete
+	}
+	return &SyntaxError{p.line, fmt.Sprintf("syntax error near unexpected token `%s'", p.peek().Text), p.index()}
+}
+
+// 現在のトークンの、ParseListに渡したトークン列での添字
+func (p *parser) index() int {
+	if p.pos >= len(p.toks) {
+		return -1
+	}
+	return p.pos
+}
+
+// 構文木を順に実行する
+// 最後に実行したコマンドの終了ステータスを返す
+// エラーは出力し、break等の制御用のエラーだけを返す
+func (ca *CmdArg) Exec(nodes []Node) (int, error) {
+	status := 0
+	for _, n := range nodes {
+		// set -nの後のコマンドは実行しない (対話モードでは無視する)
+		if ca.Sh.Options["noexec"] && !ca.Sh.Interactive {
+			return status, nil
+		}
+		var err error
+		switch n := n.(type) {
+		case *SimpleNode:
+			ca.Sh.Lineno = n.Line
+			status, err = ca.ExecSimple(n)
+		case *ForNode:
+			ca.Sh.Lineno = n.Line
+			status, err = ca.WithRedirects(n.Redirects, func() (int, error) { return ca.ExecFor(n) })
+		case *ArithForNode:
+			ca.Sh.Lineno = n.Line
+			status, err = ca.WithRedirects(n.Redirects, func() (int, error) { return ca.ExecArithFor(n) })
+		case *GroupNode:
+			ca.Sh.Lineno = n.Line
+			status, err = ca.ExecGroup(n)
+		case *PipeNode:
+			ca.Sh.Lineno = n.Line
+			status, err = ca.ExecPipe(n)
+		case *FuncNode:
+			ca.Sh.Funcs[n.Name] = n
+			status = 0
+		}
+		ca.Sh.Status = status
+		if debugMode {
+			debugf("status %d", status)
+		}
+		if IsControl(err) {
+			return status, err
+		}
+		if err != nil {
+			ca.Sh.Error(err)
+		}
+		if _, ok := n.(*SimpleNode); ok && status != 0 {
+			if err := ca.RunTrap(trapErr); err != nil {
+				return status, err
+			}
+		}
+		if err := ca.RunTraps(); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// 文字列を構文解析して実行する (複数行でもよい)
+// エラーは出力し、break等の制御用のエラーだけを返す
+func (ca *CmdArg) Eval(src string) (int, error) {
+	scanner := NewInputScanner(strings.NewReader(src))
+	var input inputLines
+	for {
+		line, err := ReadLine(scanner)
+		if err != nil {
+			break
+		}
+		input.add(line)
+	}
+
+	nodes, err := ParseList(input.toks, ca.Sh.Lineno)
+	if err != nil {
+		ca.Sh.Error(err)
+		return 2, nil
+	}
+	return ca.Exec(nodes)
+}
+
+// sourceの入れ子の深さの上限
+const maxSourceDepth = 100
+
+// ファイルを読み込んで現在のシェルで実行する
+// 行番号はファイルの1行目から数える
+func (ca *CmdArg) SourceFile(path string) (int, error) {
+	data, err := os.ReadFile(ca.Sh.abs(path))
+	if err != nil {
+		return 1, relPathError(err, path)
+	}
+	if ca.Sh.sourceDepth >= maxSourceDepth {
+		return 1, fmt.Errorf("%s: maximum source nesting level exceeded (%d)", path, maxSourceDepth)
+	}
+	lineno := ca.Sh.Lineno
+	ca.Sh.Lineno = 1
+	ca.Sh.sourceDepth++
+	defer func() {
+		ca.Sh.Lineno = lineno
+		ca.Sh.sourceDepth--
+	}()
+
+	status, err := ca.Eval(string(data))
+	if rc, ok := err.(*ReturnControl); ok {
+		return rc.Status, nil
+	}
+	return status, err
+}
+
+// 起動ファイルを実行する
+// mustでなければ、ファイルがないときは何もしない
+// 起動ファイルの実行中にpanicしても、エラーを出してシェルの起動を続ける
+// 起動ファイルがexitを実行したときだけExitControlを返す
+func (ca *CmdArg) SourceStartup(path string, must bool) error {
+	_, err := runRecover(func() (int, error) { return ca.SourceFile(path) })
+	if _, ok := err.(*ExitControl); ok {
+		return err
+	}
+	if err == nil || (!must && errors.Is(err, os.ErrNotExist)) {
+		return nil
+	}
+	if !IsControl(err) {
+		ca.Sh.Error(err)
+	}
+	return nil
+}
+
+// 変数代入か、3項間演算子やパイプを含むコマンドを実行
+func (ca *CmdArg) ExecSimple(n *SimpleNode) (int, error) {
+	if IsAssignment(n.Args) {
+		if err := ca.Sh.AssignAll(n.Args); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+
+	sca := CmdArg{Sh: ca.Sh}
+	return sca.ShellTree(n.Cmd)
+}
+
+// リダイレクト先をシェルの入出力にしてBodyを実行
+// Bodyは現在のシェルで実行するので、変数の変更などは残る
+func (ca *CmdArg) ExecGroup(n *GroupNode) (int, error) {
+	return ca.WithRedirects(n.Redirects, func() (int, error) {
+		if n.Subshell {
+			return ca.ExecSubshell(n.Body)
+		}
+		return ca.Exec(n.Body)
+	})
+}
+
+// { }やfor文の後のリダイレクトの先をシェルの入出力にしてrunを実行し、終わったら元に戻す
+func (ca *CmdArg) WithRedirects(redirects []Token, run func() (int, error)) (int, error) {
+	if len(redirects) == 0 {
+		return run()
+	}
+	sca := CmdArg{Sh: ca.Sh}
+	err := sca.ParseRedirect(redirects)
+	defer sca.CloseFiles()
+	if err != nil {
+		return 1, err
+	}
+	if len(sca.Cmd) > 0 {
+		return 2, fmt.Errorf("syntax error near unexpected token `%s'", sca.Cmd[0])
+	}
+
+	restore := ca.Sh.SetStdio(sca.In, sca.Out, sca.Err, sca.Fds)
+	defer restore()
+	return run()
+}
+
+// { }や( )を含むパイプの各段を同時に実行する
+func (ca *CmdArg) ExecPipe(n *PipeNode) (int, error) {
+	return ca.runStages(len(n.Stages), func(i int, sca *CmdArg) (int, error) {
+		return sca.Exec(n.Stages[i : i+1])
+	})
+}
+
+// シェルのコピーでBodyを実行する
+// 変数やカレントディレクトリ、umaskの変更は元のシェルに残らない
+func (ca *CmdArg) ExecSubshell(body []Node) (int, error) {
+	sca := CmdArg{Sh: ca.Sh.Clone()}
+	defer sca.Sh.CloseExecFiles()
+	status, err := sca.Exec(body)
+	// returnやbreak、exitは( )の外には伝えない
+	switch c := err.(type) {
+	case *ReturnControl:
+		return c.Status, nil
+	case *ExitControl:
+		return c.Status, nil
+	}
+	return status, nil
+}
+
+// 単語リストを展開して1つずつ変数に入れてBodyを実行
+// ループ変数はループの後も残る
+func (ca *CmdArg) ExecFor(n *ForNode) (int, error) {
+	var words []string
+	for _, w := range n.Words {
+		ws, err := ca.Sh.Expand(w)
+		if err != nil {
+			return 1, err
+		}
+		words = append(words, ws...)
+	}
+
+	ca.Sh.LoopDepth++
+	defer func() { ca.Sh.LoopDepth-- }()
+
+	status := 0
+	for _, w := range words {
+		if err := ca.Sh.SetVar(n.Name, w); err != nil {
+			return 1, err
+		}
+		var err error
+		status, err = ca.Exec(n.Body)
+		if brk, cont := LoopStep(err); brk {
+			return status, nil
+		} else if !cont && err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// for (( Init; Cond; Update ))を実行
+// 各式は変数を展開してから算術式として評価する。Condが空なら常に真
+// 外部コマンドを実行しないループも止められるように、SIGINTを受け取ったら終了する
+func (ca *CmdArg) ExecArithFor(n *ArithForNode) (int, error) {
+	arith := func(expr string) (int64, error) {
+		s, err := ca.Sh.ExpandVars(expr)
+		if err != nil {
+			return 0, err
+		}
+		return ca.Sh.Arith(s)
+	}
+
+	if _, err := arith(n.Init); err != nil {
+		return 1, err
+	}
+
+	ca.Sh.LoopDepth++
+	defer func() { ca.Sh.LoopDepth-- }()
+
+	status := 0
+	for {
+		if strings.TrimSpace(n.Cond) != "" {
+			v, err := arith(n.Cond)
+			if err != nil {
+				return 1, err
+			}
+			if v == 0 {
+				break
+			}
+		}
+		if ca.Sh.sig.takeInterrupt() {
+			return 130, nil
+		}
+
+		var err error
+		status, err = ca.Exec(n.Body)
+		if brk, cont := LoopStep(err); brk {
+			return status, nil
+		} else if !cont && err != nil {
+			return status, err
+		}
+		if _, err := arith(n.Update); err != nil {
+			return 1, err
+		}
+	}
+	return status, nil
+}
+
+// 関数の呼び出しの深さの上限
+const maxFuncDepth = 1000
+
+// 関数を呼び出す
+// 位置パラメータを引数に置き換えてBodyを実行し、終わったら元に戻す
+func (ca *CmdArg) CallFunc(fn *FuncNode, args []string) (int, error) {
+	// 無限に再帰するとGoのスタックがあふれて終了してしまう
+	if ca.Sh.FuncDepth >= maxFuncDepth {
+		return 1, fmt.Errorf("%s: maximum function nesting level exceeded (%d)", fn.Name, maxFuncDepth)
+	}
+	saved := ca.Sh.Args
+	ca.Sh.Args = args
+	ca.Sh.FuncDepth++
+	ca.Sh.PushScope()
+	defer func() {
+		ca.Sh.PopScope()
+		ca.Sh.Args = saved
+		ca.Sh.FuncDepth--
+	}()
+
+	status, err := ca.Exec(fn.Body)
+	if rc, ok := err.(*ReturnControl); ok {
+		return rc.Status, nil
+	}
+	return status, err
+}
+
+/*
+	break/continue/return/exit
+*/
+// break/continueを外側のループに伝えるためのエラー
+type LoopControl struct {
+	Break bool
+	N     int // 抜けるループの段数
+}
+
+func (e *LoopControl) Error() string {
+	if e.Break {
+		return "break: only meaningful in a loop"
+	}
+	return "continue: only meaningful in a loop"
+}
+
+// returnで関数を抜けるためのエラー
+type ReturnControl struct {
+	Status int
+}
+
+func (e *ReturnControl) Error() string {
+	return "return: can only `return' from a function"
+}
+
+// exitでシェルを終了するためのエラー
+// パイプの中のコマンドや( )ではその中だけを終了する
+type ExitControl struct {
+	Status int
+}
+
+func (e *ExitControl) Error() string {
+	return fmt.Sprintf("exit %d", e.Status)
+}
+
+// 制御用のエラーか (通常のエラーと違い出力せずに呼び出し元へ返す)
+func IsControl(err error) bool {
+	switch err.(type) {
+	case *LoopControl, *ReturnControl, *ExitControl:
+		return true
+	}
+	return false
+}
+
+// ループ本体が返したエラーからループをどう進めるか決める
+// brkならループを終了、contなら次の繰り返しへ
+// さらに外側のループを抜ける場合はNを減らしてエラーのまま返す
+func LoopStep(err error) (brk, cont bool) {
+	lc, ok := err.(*LoopControl)
+	if !ok {
+		return false, false
+	}
+	if lc.N > 1 {
+		lc.N--
+		return false, false
+	}
+	return lc.Break, !lc.Break
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFor(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "cc.go", "d.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"words", `for x in a "b c" d; do echo $x; done`, "a\nb c\nd\n"},
+		{"empty list", `for x in; do echo no; done; echo end`, "end\n"},
+		{"variable", `v="1 2"; for x in $v 3; do echo $x; done`, "1\n2\n3\n"},
+		{"nested", `for i in 1 2; do for j in a b; do echo $i$j; done; done`, "1a\n1b\n2a\n2b\n"},
+		{"break", `for i in 1 2 3; do echo $i; break; done`, "1\n"},
+		{"star glob", `for x in *.go; do echo $x; done`, "a.go\nb.go\ncc.go\n"},
+		{"question glob", `for x in ?.go; do echo $x; done`, "a.go\nb.go\n"},
+		{"two questions", `for x in ??.go; do echo $x; done`, "cc.go\n"},
+		{"no match", `for x in ?.c; do echo $x; done`, "?.c\n"},
+		{"quoted question", `for x in "?.go"; do echo "$x"; done`, "?.go\n"},
+		{"multiple lines", "for x in a b\ndo\necho $x\ndone", "a\nb\n"},
+		{"redirect whole loop", `for i in 1 2; do echo $i; done > out; cat out`, "1\n2\n"},
+		{"redirect stdin", `printf 'a\nb\n' > in; for i in 1 2; do read x; echo $i$x; done < in`, "1a\n2b\n"},
+		{"pipe from loop", `for i in 3 1 2; do echo $i; done | sort`, "1\n2\n3\n"},
+		{"pipe into loop", `echo a | for i in 1; do cat; done`, "a\n"},
+		{"loop between stages", `echo a | for i in 1; do cat; echo b; done | cat`, "a\nb\n"},
+		{"loop in pipe is a copy", `i=0; for i in 1 2; do true; done | cat; echo $i`, "0\n"},
+		{"arithmetic loop redirect", `for ((i = 0; i < 2; i++)); do echo $i; done > out; cat out`, "0\n1\n"},
+		{"arithmetic loop pipe", `for ((i = 0; i < 3; i++)); do echo $i; done | tail -n 1`, "2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestArithFor(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"sum", `s=0; for ((i = 1; i <= 10; i++)); do let s+=i; done; echo $s $i`, "55 11\n"},
+		{"no spaces", `for ((i=0;i<3;i++)); do echo $i; done`, "0\n1\n2\n"},
+		{"count down", `n=3; for ((i = n; i > 0; i--)); do echo $i; done`, "3\n2\n1\n"},
+		{"no iterations", `for ((i = 0; i < 0; i++)); do echo x; done; echo $i`, "0\n"},
+		{"break", `for ((i = 0; ; i++)); do [ $i -eq 3 ] ? break : echo $i; done`, "0\n1\n2\n"},
+		{"continue runs update", `for ((i = 0; i < 5; i++)); do let "i % 2" ? continue : echo $i; done`, "0\n2\n4\n"},
+		{"nested break", `for ((i = 0; i < 2; i++)); do for ((j = 0; j < 3; j++)); do [ $j -eq 1 ] ? break : echo $i$j; done; done`, "00\n10\n"},
+		{"empty expressions", `for ((;;)); do echo x; break; done`, "x\n"},
+		{"empty init and update", `i=0; for (( ; i < 2; )); do let i++; echo $i; done`, "1\n2\n"},
+		{"multiple lines", "for ((i = 0; i < 2; i++))\ndo\n  echo $i\ndone", "0\n1\n"},
+		{"in function", `f() { for ((i = 0; i < $1; i++)); do echo $i; done; }; f 2`, "0\n1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestArithForErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"two expressions", `for ((i = 0; i < 2)); do echo; done`, "arithmetic expression required"},
+		{"missing do", `for ((i = 0; i < 2; i++)) echo; done`, "near unexpected token `echo'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errOut, status := runShell(t, tt.src)
+			if status != 2 || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got status %d (stderr %q), want 2 and %q", tt.src, status, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"comment line", "# comment\necho a", "a\n"},
+		{"trailing comment", "echo a # b c", "a\n"},
+		{"after separator", "echo a;# b", "a\n"},
+		{"inside word", "echo a#b", "a#b\n"},
+		{"quoted", `echo "# a" '#b' \#c`, "# a #b #c\n"},
+		{"length and count", `V=abc; f() { echo ${#V} $#; }; f x y`, "3 2\n"},
+		{"separators in comment", "echo a # | cat; echo b > f", "a\n"},
+		{"for loop", "for x in a b # words\ndo # body\n  # comment line\n\n  echo $x # echo\n\ndone # end\necho end", "a\nb\nend\n"},
+		{"function", "f() { # start\n  # comment\n\n  echo in\n} # end\nf", "in\n"},
+		{"group", "{\n  # comment\n  echo a\n\n}", "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, "cd "+t.TempDir()+"\n"+tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestTokenizeQuestion(t *testing.T) {
+	tests := []struct {
+		line string
+		want []Token
+	}{
+		{"ls ?.go", []Token{{"ls", WordToken, 0, 2}, {"?.go", WordToken, 3, 7}}},
+		{"a ? b", []Token{{"a", WordToken, 0, 1}, {"?", OperatorToken, 2, 3}, {"b", WordToken, 4, 5}}},
+		{"echo $?", []Token{{"echo", WordToken, 0, 4}, {"$?", WordToken, 5, 7}}},
+		{"[[ x == ? ]]", []Token{{"[[", WordToken, 0, 2}, {"x", WordToken, 3, 4}, {"==", WordToken, 5, 7}, {"?", WordToken, 8, 9}, {"]]", WordToken, 10, 12}}},
+	}
+	for _, tt := range tests {
+		got := Tokenize(tt.line)
+		if len(got) != len(tt.want) {
+			t.Errorf("Tokenize(%q) = %v, want %v", tt.line, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Tokenize(%q)[%d] = %v, want %v", tt.line, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"variables kept", `{ x=1; echo a; }; echo $x`, "a\n1\n"},
+		{"redirect whole group", `{ echo a; echo b; } > out; cat out`, "a\nb\n"},
+		{"redirect stdin", `echo hi > in; { read x; echo [$x]; } < in`, "[hi]\n"},
+		{"multiple lines", "{\necho a\necho b\n}", "a\nb\n"},
+		{"pipe from group", `{ echo a; echo b; } | cat`, "a\nb\n"},
+		{"pipe into group", `echo d | { read x; echo [$x]; }`, "[d]\n"},
+		{"group in pipe is a copy", `x=1; echo | { x=2; }; echo $x`, "1\n"},
+		{"group between stages", `echo a | { cat; echo b; } | cat`, "a\nb\n"},
+		{"redirect then pipe", `{ echo a; } 2> err | cat`, "a\n"},
+		{"pipestatus", `{ true; } | false | { true; }; echo ${PIPESTATUS[@]}`, "0 1 0\n"},
+		{"pipefail", `set -o pipefail; { false; } | cat; echo $?`, "1\n"},
+		{"or in [[ ]] is not a pipe", `[[ a == b || ( a == a ) ]]; echo $?`, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestGroupSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"word after }", `{ echo a; } b`, "near unexpected token `b'"},
+		{"unclosed", `{ echo a;`, "unexpected end of input"},
+		{"stray }", `}`, "near unexpected token `}'"},
+		{"ternary in group pipe", `true ? echo y | { cat; }`, "near unexpected token `?'"},
+		{"word after done", `for i in 1; do echo; done b`, "near unexpected token `b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errOut, status := runShell(t, tt.src)
+			if status != 2 || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got status %d (stderr %q), want 2 and %q", tt.src, status, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestSubshell(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"variables not kept", `x=1; ( x=2; echo $x ); echo $x`, "2\n1\n"},
+		{"status", `( false ); echo $?`, "1\n"},
+		{"nested", `( ( echo a ); echo b )`, "a\nb\n"},
+		{"redirect", `( echo a; echo b ) > out; cat out`, "a\nb\n"},
+		{"pipe from subshell", `( echo c ) | cat`, "c\n"},
+		{"pipe into subshell", `echo e | ( cat ) | cat`, "e\n"},
+		{"subshell and group", `( echo a ) | { cat; echo b; }`, "a\nb\n"},
+		{"return stays inside", `f() { ( return 3 ); echo after $?; }; f`, "after 3\n"},
+		{"multiple lines", "(\necho a\n)", "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, src := range []string{
+		`for x in a "b c" d; do echo $x; done`,
+		"for x in a b\ndo\necho $x\ndone",
+		`for ((i = 0; i < 3; i++)); do echo $i; done | tail -n 1`,
+		`for i in 1 2; do echo $i; done > out`,
+		`{ echo a; echo b; } > out; cat out`,
+		`echo a | { cat; echo b; } | cat`,
+		`( ( echo a ); echo b )`,
+		`f() { ( return 3 ); echo after $?; }; f`,
+		`true ? false ? echo a : echo b : echo c`,
+		`[[ ( a == b || a == a ) && c == c ]]; echo $?`,
+		`echo a | | cat`,
+		`( echo a | )`,
+		`{ echo a; } b`,
+		`echo "|" '|' \| ">" '2>'`,
+		`a=(x "y z" w); echo ${a[1]} ${#a[@]}`,
+		`diff <(echo x) > >(cat) 2>&1 <&-`,
+		`echo ${x:-a b} ${y#*/} # comment`,
+		`cmd 2>err >|out <in`,
+		`exec 10>f 3<&10; echo a 12>&-`,
+	} {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		var input inputLines
+		for _, line := range strings.Split(src, "\n") {
+			for _, tok := range Tokenize(line) {
+				// トークンは行の中の位置を指す
+				if tok.Start < 0 || tok.End > len(line) || tok.Start >= tok.End || line[tok.Start:tok.End] != tok.Text {
+					t.Fatalf("Tokenize(%q): bad token %+v", line, tok)
+				}
+			}
+			input.add(line)
+		}
+		_, err := ParseList(input.toks, 1)
+		var se *SyntaxError
+		switch {
+		case err == nil, err == ErrIncomplete:
+		case errors.As(err, &se):
+			if se.Tok >= len(input.toks) {
+				t.Fatalf("ParseList(%q): error token %d out of range", src, se.Tok)
+			}
+			if se.Tok >= 0 {
+				input.caret(se.Tok)
+			}
+		default:
+			t.Fatalf("ParseList(%q): unexpected error %v", src, err)
+		}
+	})
+}
+
+func TestNoexec(t *testing.T) {
+	tests := []struct {
+		name, script, out, err string
+		status                 int
+	}{
+		{"nothing runs", "echo a\nfor x in 1 2; do echo $x; done\n", "", "", 0},
+		{"syntax error", "echo a\ndone\necho b\n", "", "line 2: syntax error near unexpected token `done'", 2},
+		{"unfinished loop", "echo a\nfor x in a; do\necho b\n", "", "line 3: syntax error: unexpected end of input", 2},
+		{"no side effects", "echo a > DIR/f\nf() { echo x; }\nf\n", "", "", 0},
+	}
+	// スクリプトのDIRはテスト用のディレクトリにする
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			script := filepath.Join(dir, "s.sh")
+			if err := os.WriteFile(script, []byte(strings.ReplaceAll(tt.script, "DIR", dir)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			out, errOut, status := runMain(t, "", "-n", script)
+			if out != tt.out || status != tt.status || (tt.err == "") != (errOut == "") || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q, status %d (stderr %q), want %q, status %d, stderr %q", tt.script, out, status, errOut, tt.out, tt.status, tt.err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "f")); err == nil {
+				t.Errorf("%q: created a file", tt.script)
+			}
+		})
+	}
+
+	// set -nの後のコマンドは実行しない (対話モードでは無視する)
+	out, _, _ := runMain(t, "echo a\nset -n\necho b\n")
+	if out != "a\n" {
+		t.Errorf("set -n: got %q, want %q", out, "a\n")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+	TOYSHELL_DEBUGによるデバッグ用のログ
+*/
+// TOYSHELL_DEBUGが空でなければtrue (起動時に1回だけ調べる)
+var debugMode = os.Getenv("TOYSHELL_DEBUG") != ""
+
+// デバッグ用のログを標準エラー出力に出す
+// コマンドの出力と区別できるように各行の先頭に印を付ける
+// 引数を作るだけでもアロケーションがあるので、よく通る場所ではif debugModeの中で呼ぶ
+func debugf(format string, args ...interface{}) {
+	if !debugMode {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[toyshell debug] "+format+"\n", args...)
+}
+
+// 構文木をインデントを付けて出力する
+func debugNodes(nodes []Node, depth int) {
+	if !debugMode {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *SimpleNode:
+			debugf("%sline %d: simple %q", indent, n.Line, Words(n.Args))
+		case *ForNode:
+			debugf("%sline %d: for %s in %q", indent, n.Line, n.Name, n.Words)
+			debugNodes(n.Body, depth+1)
+		case *ArithForNode:
+			debugf("%sline %d: for ((%s;%s;%s))", indent, n.Line, n.Init, n.Cond, n.Update)
+			debugNodes(n.Body, depth+1)
+		case *GroupNode:
+			kind := "group"
+			if n.Subshell {
+				kind = "subshell"
+			}
+			debugf("%sline %d: %s redirects=%q", indent, n.Line, kind, Words(n.Redirects))
+			debugNodes(n.Body, depth+1)
+		case *PipeNode:
+			debugf("%sline %d: pipe", indent, n.Line)
+			debugNodes(n.Stages, depth+1)
+		case *FuncNode:
+			debugf("%sfunction %s", indent, n.Name)
+			debugNodes(n.Body, depth+1)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebug(t *testing.T) {
+	const src = "echo a | cat; for i in 1; do echo $i > /dev/null; done\n"
+
+	t.Setenv("TOYSHELL_DEBUG", "1")
+	out, errOut, status := runMain(t, src)
+	if out != "a\n" || status != 0 {
+		t.Errorf("TOYSHELL_DEBUG=1: got %q, status %d, want %q", out, status, "a\n")
+	}
+	for _, want := range []string{
+		"[toyshell debug] line 1: simple [\"echo\" \"a\" \"|\" \"cat\"]\n",
+		"[toyshell debug] line 1: for i in [\"1\"]\n",
+		"[toyshell debug]   line 1: simple [\"echo\" \"$i\" \">\" \"/dev/null\"]\n",
+		"[toyshell debug] fork pid ",
+		"[toyshell debug] redirect [\"echo\" \"1\"]: stdin=/dev/stdin stdout=/dev/null",
+		"[toyshell debug] status 0\n",
+	} {
+		if !strings.Contains(errOut, want) {
+			t.Errorf("TOYSHELL_DEBUG=1: stderr %q, want %q", errOut, want)
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(errOut, "\n"), "\n") {
+		if !strings.HasPrefix(l, "[toyshell debug] ") {
+			t.Errorf("TOYSHELL_DEBUG=1: stderr line %q has no debug prefix", l)
+		}
+	}
+
+	t.Setenv("TOYSHELL_DEBUG", "")
+	out, errOut, status = runMain(t, src)
+	if out != "a\n" || errOut != "" || status != 0 {
+		t.Errorf("no TOYSHELL_DEBUG: got %q, status %d (stderr %q), want %q", out, status, errOut, "a\n")
+	}
+}
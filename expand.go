@@ -0,0 +1,561 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	シェル変数と単語の展開
+*/
+// 変数の値を取得 (シェル変数がなければ環境変数)
+func (sh *Shell) Get(name string) string {
+	v, _ := sh.Lookup(name)
+	return v
+}
+
+// 変数の値と、変数が設定されているかを返す
+func (sh *Shell) Lookup(name string) (string, bool) {
+	// 配列の要素
+	if base, sub, ok := splitSubscript(name); ok {
+		return sh.element(base, sub)
+	}
+
+	// 位置パラメータ
+	if n, err := strconv.Atoi(name); err == nil {
+		if n == 0 {
+			return sh.Name, true
+		}
+		if n < 1 || n > len(sh.Args) {
+			return "", false
+		}
+		return sh.Args[n-1], true
+	}
+	switch name {
+	case "@", "*":
+		return strings.Join(sh.Args, " "), true
+	case "#":
+		return strconv.Itoa(len(sh.Args)), true
+	case "?":
+		return strconv.Itoa(sh.Status), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "!":
+		if sh.LastBg == 0 {
+			return "", false
+		}
+		return strconv.Itoa(sh.LastBg), true
+	// 読むたびに値が変わる変数
+	case "RANDOM":
+		return strconv.Itoa(sh.random.Intn(32768)), true
+	case "SECONDS":
+		return strconv.Itoa(int(time.Since(sh.start).Seconds())), true
+	case "LINENO":
+		return strconv.Itoa(sh.Lineno), true
+	}
+
+	if v, ok := sh.Vars[name]; ok {
+		return v, true
+	}
+	// 配列の名前だけなら要素0
+	if arr, ok := sh.Arrays[name]; ok {
+		if len(arr) == 0 {
+			return "", false
+		}
+		return arr[0], true
+	}
+	if m, ok := sh.Assoc[name]; ok {
+		v, ok := m["0"]
+		return v, ok
+	}
+	return os.LookupEnv(name)
+}
+
+// 変数に値を代入する
+// RANDOMへの代入は乱数の種に、SECONDSへの代入は経過秒数の起点になる
+// readonlyの変数には代入できず、declare -iの変数には算術式の値を代入する
+func (sh *Shell) SetVar(name, value string) error {
+	switch name {
+	case "RANDOM":
+		n, _ := strconv.ParseInt(value, 10, 64)
+		sh.random.Seed(n)
+		return nil
+	case "SECONDS":
+		n, _ := strconv.Atoi(value)
+		sh.start = time.Now().Add(-time.Duration(n) * time.Second)
+		return nil
+	}
+	if _, ok := sh.Arrays[name]; ok {
+		return sh.SetElement(name, "0", value)
+	}
+	if _, ok := sh.Assoc[name]; ok {
+		return sh.SetElement(name, "0", value)
+	}
+	value, err := sh.attrValue(name, value)
+	if err != nil {
+		return err
+	}
+	sh.Vars[name] = value
+	return nil
+}
+
+// 変数の属性 (readonly, integer) に従って代入する値を決める
+func (sh *Shell) attrValue(name, value string) (string, error) {
+	if sh.Readonly[name] {
+		return "", fmt.Errorf("%s: readonly variable", name)
+	}
+	if sh.Integers[name] {
+		n, err := sh.Arith(value)
+		if err != nil {
+			return "", err
+		}
+		value = strconv.FormatInt(n, 10)
+	}
+	return value, nil
+}
+
+// 直前のパイプの各コマンドの終了ステータスを配列$PIPESTATUSに入れる
+func (sh *Shell) SetPipeStatus(statuses []int) {
+	s := make([]string, len(statuses))
+	for i, st := range statuses {
+		s[i] = strconv.Itoa(st)
+	}
+	sh.SetArray("PIPESTATUS", s)
+}
+
+// 変数を設定して子プロセスにも渡す
+func (sh *Shell) Export(name, value string) error {
+	if err := sh.SetVar(name, value); err != nil {
+		return err
+	}
+	sh.Exported[name] = true
+	return nil
+}
+
+// 子プロセスに渡す環境変数
+// 起動時の環境変数 (シェルで変更した値を含む) に、exportした変数を加える
+func (sh *Shell) Environ() []string {
+	var env []string
+	seen := map[string]bool{}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		seen[name] = true
+		if v, ok := sh.Vars[name]; ok {
+			kv = name + "=" + v
+		}
+		env = append(env, kv)
+	}
+
+	var names []string
+	for name := range sh.Exported {
+		if _, ok := sh.Vars[name]; ok && !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+sh.Vars[name])
+	}
+	return env
+}
+
+// localで隠す前の変数の値
+type savedVar struct {
+	value string
+	set   bool
+}
+
+// 関数呼び出しのスコープを作る
+func (sh *Shell) PushScope() {
+	sh.locals = append(sh.locals, map[string]savedVar{})
+}
+
+// スコープを抜けて、その中でlocalにした変数を元に戻す
+func (sh *Shell) PopScope() {
+	top := sh.locals[len(sh.locals)-1]
+	sh.locals = sh.locals[:len(sh.locals)-1]
+	for name, v := range top {
+		if v.set {
+			sh.Vars[name] = v.value
+		} else {
+			delete(sh.Vars, name)
+		}
+	}
+}
+
+// 変数を現在の関数のローカル変数にする
+// 元の値は関数から戻るときに戻す
+func (sh *Shell) Local(name string) {
+	top := sh.locals[len(sh.locals)-1]
+	if _, ok := top[name]; ok {
+		return
+	}
+	v, set := sh.Vars[name]
+	top[name] = savedVar{v, set}
+}
+
+// NAME=valueかNAME[subscript]=valueを処理
+func (sh *Shell) Assign(word string) error {
+	i := strings.Index(word, "=")
+	v, err := sh.ExpandVars(word[i+1:])
+	if err != nil {
+		return err
+	}
+	if name, sub, ok := splitSubscript(word[:i]); ok {
+		return sh.SetElement(name, sub, v)
+	}
+	return sh.SetVar(word[:i], v)
+}
+
+// IsAssignmentを満たすトークン列の代入を順に行う
+// NAME=( a b c )は配列の代入になる
+func (sh *Shell) AssignAll(args []Token) error {
+	for i := 0; i < len(args); i++ {
+		name, value, _ := strings.Cut(args[i].Text, "=")
+		if value == "" && i+1 < len(args) && args[i+1].Is(OperatorToken, "(") {
+			end := closeParen(args, i+1)
+			var words []string
+			for _, w := range args[i+2 : end] {
+				ws, err := sh.Expand(w.Text)
+				if err != nil {
+					return err
+				}
+				words = append(words, ws...)
+			}
+			if err := sh.AssignArray(name, words); err != nil {
+				return err
+			}
+			i = end
+			continue
+		}
+		if err := sh.Assign(args[i].Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 変数名として使えるか
+func IsName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			continue
+		}
+		if i > 0 && '0' <= c && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// すべての単語がNAME=value、NAME[subscript]=value、NAME=( ... )の形か
+func IsAssignment(args []Token) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for i := 0; i < len(args); i++ {
+		if args[i].Kind != WordToken {
+			return false
+		}
+		a := args[i].Text
+		j := strings.Index(a, "=")
+		if j <= 0 {
+			return false
+		}
+		if _, _, ok := splitSubscript(a[:j]); ok {
+			continue
+		}
+		if !IsName(a[:j]) {
+			return false
+		}
+		// NAME=( ... )
+		if j == len(a)-1 && i+1 < len(args) && args[i+1].Is(OperatorToken, "(") {
+			end := closeParen(args, i+1)
+			if end == -1 {
+				return false
+			}
+			i = end
+		}
+	}
+	return true
+}
+
+// 単語を展開する
+// クォートの外の変数展開の結果は空白で分割し、*などを含む単語はファイル名に展開する
+func (sh *Shell) Expand(word string) ([]string, error) {
+	// "$@"は引数をそれぞれ1つの単語にする
+	if word == `"$@"` {
+		return append([]string{}, sh.Args...), nil
+	}
+
+	e := expander{sh: sh}
+	e.expand(word)
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	var out []string
+	for i, f := range e.fields {
+		if e.metas[i] {
+			matches, err := sh.Glob(f, e.pats[i])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, matches...)
+		} else {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// 変数展開とクォートの除去だけを行い、分割はしない
+// 代入の右辺やリダイレクト先に使う
+func (sh *Shell) ExpandVars(word string) (string, error) {
+	e := expander{sh: sh, noSplit: true}
+	e.expand(word)
+	return strings.Join(e.fields, ""), e.err
+}
+
+// 変数展開とクォートの除去をしたパターンを返す
+// クォートされた*などは\でエスケープされる
+func (sh *Shell) ExpandPattern(word string) (string, error) {
+	e := expander{sh: sh, noSplit: true}
+	e.expand(word)
+	return strings.Join(e.pats, ""), e.err
+}
+
+// 展開中の単語
+type expander struct {
+	sh      *Shell
+	noSplit bool
+	err     error // 最初に起きたエラー
+
+	// 確定したフィールドとグロブ用のパターン
+	fields []string
+	pats   []string
+	metas  []bool
+
+	cur  strings.Builder
+	pat  strings.Builder
+	meta bool // curにクォートされていない*などが含まれる
+	keep bool // curが空でもフィールドとして残す ("")
+}
+
+func (e *expander) expand(word string) {
+	inDouble := false
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		switch {
+		case c == '\\' && i+1 < len(word):
+			// ダブルクォートの中では$ ` " \だけをエスケープする
+			if inDouble && !strings.ContainsRune("$`\"\\", rune(word[i+1])) {
+				e.lit("\\", true)
+				continue
+			}
+			i++
+			e.lit(word[i:i+1], true)
+		case c == '\'' && !inDouble:
+			j := strings.IndexByte(word[i+1:], '\'')
+			if j == -1 {
+				j = len(word) - i - 1
+			}
+			e.keep = true
+			e.lit(word[i+1:i+1+j], true)
+			i += j + 1
+		case c == '"':
+			if !inDouble {
+				e.keep = true
+			}
+			inDouble = !inDouble
+		case c == '$':
+			expr, n := scanParam(word[i:])
+			if n == 0 {
+				e.lit("$", inDouble)
+				continue
+			}
+			e.param(expr, inDouble)
+			i += n - 1
+		default:
+			e.lit(word[i:i+1], inDouble)
+		}
+	}
+	e.next()
+}
+
+// $の後のパラメータ名を読む
+// ${...}なら中身を返す。nは読んだバイト数 (パラメータでなければ0)
+func scanParam(s string) (expr string, n int) {
+	if len(s) < 2 {
+		return "", 0
+	}
+	if s[1] == '{' {
+		j := IndexUnquoted(s[2:], "}")
+		if j == -1 {
+			return "", 0
+		}
+		return s[2 : j+2], j + 3
+	}
+
+	// $1や$@などの1文字の特殊なパラメータ
+	if c := s[1]; ('0' <= c && c <= '9') || strings.IndexByte("@*#?$!", c) >= 0 {
+		return s[1:2], 2
+	}
+
+	j := 1
+	for j < len(s) && IsName(s[1:j+1]) {
+		j++
+	}
+	if j == 1 {
+		return "", 0
+	}
+	return s[1:j], j
+}
+
+// パラメータを展開してcurに追加
+func (e *expander) param(expr string, quoted bool) {
+	name, op, word := splitParam(expr)
+
+	// "...$@..."や"${NAME[@]}"は要素ごとに別の単語にする
+	// "${!NAME[@]}"は添字ごとに別の単語にする
+	words, ok := e.sh.Words(name)
+	ok = ok && op == ""
+	if name == "" && op == "!" && strings.HasSuffix(word, "[@]") {
+		base, _, _ := splitSubscript(word)
+		words, ok = e.sh.Keys(base), true
+	}
+	// 空の要素も1つの単語にし、要素がなければ"${NAME[@]}"は何も残さない
+	if ok && quoted && !e.noSplit {
+		if len(words) == 0 && e.cur.Len() == 0 {
+			e.keep = false
+		}
+		for i, a := range words {
+			if i > 0 {
+				e.next()
+			}
+			e.keep = true
+			e.lit(a, true)
+		}
+		return
+	}
+
+	v, err := e.sh.Param(name, op, word)
+	if err != nil {
+		if e.err == nil {
+			e.err = err
+		}
+		return
+	}
+	e.value(v, quoted)
+}
+
+// 展開した値をcurに追加
+// クォートされていなければ空白で分割する
+func (e *expander) value(v string, quoted bool) {
+	if quoted || e.noSplit {
+		e.lit(v, true)
+		return
+	}
+	for i := 0; i < len(v); i++ {
+		if strings.IndexByte(" \t\n", v[i]) >= 0 {
+			e.next()
+			continue
+		}
+		e.lit(v[i:i+1], false)
+	}
+}
+
+// 文字列をそのままcurに追加
+func (e *expander) lit(s string, quoted bool) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		e.cur.WriteByte(c)
+		if strings.IndexByte("*?[", c) >= 0 {
+			if quoted {
+				e.pat.WriteByte('\\')
+			} else {
+				e.meta = true
+			}
+		}
+		e.pat.WriteByte(c)
+	}
+}
+
+// curを1つのフィールドとして確定する
+func (e *expander) next() {
+	if e.cur.Len() > 0 || e.keep {
+		e.fields = append(e.fields, e.cur.String())
+		e.pats = append(e.pats, e.pat.String())
+		e.metas = append(e.metas, e.meta)
+	}
+	e.cur.Reset()
+	e.pat.Reset()
+	e.meta = false
+	e.keep = false
+}
+
+// sの中のパターンの記号を\でクォートする
+func globQuote(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[\`, s[i]) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// matchの/で区切った部分のうち、.で始まるのにパターンの同じ部分が.で始まらないものがあるか
+func hiddenMatch(pattern, match string) bool {
+	ps := strings.Split(pattern, "/")
+	ms := strings.Split(match, "/")
+	for i := 1; i <= len(ps) && i <= len(ms); i++ {
+		if strings.HasPrefix(ms[len(ms)-i], ".") && !strings.HasPrefix(ps[len(ps)-i], ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// パターンに一致するファイル名に展開する
+// 相対パスのパターンはシェルのカレントディレクトリから探す
+// 一致するものがなければそのまま返す
+// nullglobなら何も返さず、failglobならエラーにする
+func (sh *Shell) Glob(word, pattern string) ([]string, error) {
+	prefix := ""
+	if !filepath.IsAbs(pattern) && sh.Dir != "" {
+		prefix = sh.Dir + "/"
+	}
+	matches, err := filepath.Glob(globQuote(prefix) + pattern)
+	if err != nil {
+		return []string{word}, nil
+	}
+	// .で始まるファイル名には、パターンも.で始まるときだけ一致する
+	matches = slices.DeleteFunc(matches, func(m string) bool {
+		return hiddenMatch(pattern, strings.TrimPrefix(m, prefix))
+	})
+	for i, m := range matches {
+		matches[i] = strings.TrimPrefix(m, prefix)
+	}
+	if len(matches) > 0 {
+		return matches, nil
+	}
+	switch {
+	case sh.Options["nullglob"]:
+		return nil, nil
+	case sh.Options["failglob"]:
+		return nil, fmt.Errorf("no match: %s", word)
+	}
+	return []string{word}, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"colon assignment", `P=a:b; echo $P`, "a:b\n"},
+		{"export colon", `export Q=x:y; printenv Q`, "x:y\n"},
+		{"append to path", `P=/bin; P=$P:/x; echo $P`, "/bin:/x\n"},
+		{"child sees export", `export Q=x:y; sh -c 'echo $Q'`, "x:y\n"},
+		{"unexported not passed", `Q=1; sh -c 'echo "[$Q]"'`, "[]\n"},
+		{"export later", `Q=1; export Q; sh -c 'echo $Q'`, "1\n"},
+		{"export -n", `export Q=1; export -n Q; sh -c 'echo "[$Q]"'; echo $Q`, "[]\n1\n"},
+		{"changed value", `export Q=1; Q=2; printenv Q`, "2\n"},
+		{"env prints export", `export Q=a:b; env | grep ^Q=`, "Q=a:b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestTernaryColon(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"true", `true ? echo y : echo n`, "y\n"},
+		{"false", `false ? echo y : echo n`, "n\n"},
+		{"colon in branch", `true ? echo a:b : echo n`, "a:b\n"},
+		{"nested", `true ? false ? echo a : echo b : echo c`, "b\n"},
+		{"colon argument", `echo a : b`, "a : b\n"},
+		{"reset at semicolon", `true ? echo y : echo n; echo a : b`, "y\na : b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestTokenizeColon(t *testing.T) {
+	tests := []struct {
+		line string
+		want []TokenKind
+	}{
+		{"P=a:b", []TokenKind{WordToken}},
+		{"echo : x", []TokenKind{WordToken, WordToken, WordToken}},
+		{"a ? b : c", []TokenKind{WordToken, OperatorToken, WordToken, OperatorToken, WordToken}},
+		{"a ? b ; c : d", []TokenKind{WordToken, OperatorToken, WordToken, OperatorToken, WordToken, WordToken, WordToken}},
+		{"a ? ( b : c ) : d", []TokenKind{WordToken, OperatorToken, OperatorToken, WordToken, WordToken, WordToken, OperatorToken, OperatorToken, WordToken}},
+		{"[[ a == b : c ]]", []TokenKind{WordToken, WordToken, WordToken, WordToken, WordToken, WordToken, WordToken}},
+	}
+	for _, tt := range tests {
+		got := Tokenize(tt.line)
+		if len(got) != len(tt.want) {
+			t.Errorf("Tokenize(%q) = %v, want kinds %v", tt.line, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Kind != tt.want[i] {
+				t.Errorf("Tokenize(%q)[%d] = %v, want kind %v", tt.line, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", ".hidden", "sub/c", "sub/.d", ".dir/e"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"star skips dotfiles", `echo *`, "a b sub\n"},
+		{"for skips dotfiles", `for x in *; do echo $x; done`, "a\nb\nsub\n"},
+		{"question skips dotfiles", `echo ?hidden`, "?hidden\n"},
+		{"dot pattern", `echo .h*`, ".hidden\n"},
+		{"subdirectory", `echo sub/*`, "sub/c\n"},
+		{"dot in subdirectory", `echo sub/.*`, "sub/.d\n"},
+		{"hidden directory", `echo */e; echo .*/e`, "*/e\n.dir/e\n"},
+		{"absolute", `echo ` + dir + `/*`, dir + "/a " + dir + "/b " + dir + "/sub\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, `cd `+dir+`; `+tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestGlobOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"literal", `echo x *.none y`, "x *.none y\n"},
+		{"match", `echo *.go`, "a.go b.go\n"},
+		{"nullglob", `set -o nullglob; echo x *.none y`, "x y\n"},
+		{"nullglob shopt", `shopt -s nullglob; echo x *.none y`, "x y\n"},
+		{"nullglob loop", `set -o nullglob; for f in *.none; do echo $f; done; echo end`, "end\n"},
+		{"nullglob match", `set -o nullglob; echo *.go`, "a.go b.go\n"},
+		{"failglob match", `set -o failglob; echo *.go`, "a.go b.go\n"},
+		{"failglob quoted", `set -o failglob; echo "*.none"`, "*.none\n"},
+		{"failglob after nullglob", `set -o nullglob; set -o failglob; echo x *.none; echo $?`, "1\n"},
+		{"nullglob after failglob", `set -o failglob; set -o nullglob; echo x *.none`, "x\n"},
+		{"failglob off", `set -o failglob; set +o failglob; echo *.none`, "*.none\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, `cd `+dir+`; `+tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+
+	out, errOut, _ := runShell(t, `cd `+dir+`; set -o failglob; echo *.none; echo $?`)
+	if out != "1\n" || !strings.Contains(errOut, "no match: *.none") {
+		t.Errorf("failglob: got %q (stderr %q), want status 1 and no match", out, errOut)
+	}
+}
+
+func TestPositionalParams(t *testing.T) {
+	tests := []struct {
+		name, script, out string
+	}{
+		{"count and values", `echo $# $1 $2`, "2 a b c\n"},
+		{"quoted at", `for a in "$@"; do echo "[$a]"; done`, "[a]\n[b c]\n"},
+		{"quoted star", `for a in "$*"; do echo "[$a]"; done`, "[a b c]\n"},
+		{"unquoted star", `for a in $*; do echo "[$a]"; done`, "[a]\n[b]\n[c]\n"},
+		{"unset parameter", `echo "[$3]"`, "[]\n"},
+		{"function scope", `f() { echo $# $1; }; f x y z; echo $1`, "3 x\na\n"},
+		{"function quoted at", `f() { echo $#; }; f "$@"`, "2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := filepath.Join(t.TempDir(), "script.sh")
+			if err := os.WriteFile(script, []byte(tt.script+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			out, errOut, _ := runMain(t, "", script, "a", "b c")
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.script, out, errOut, tt.out)
+			}
+		})
+	}
+
+	script := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(script, []byte("echo $0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, _, _ := runMain(t, "", script); out != script+"\n" {
+		t.Errorf("$0: got %q, want %q", out, script+"\n")
+	}
+}
+
+func TestParamDefault(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"default set", `V=x; echo ${V:-d}`, "x\n"},
+		{"default unset", `echo ${V:-d}; echo "[$V]"`, "d\n[]\n"},
+		{"default empty", `V=; echo ${V:-d}`, "d\n"},
+		{"default empty without colon", `V=; echo "[${V-d}]"`, "[]\n"},
+		{"default unset without colon", `echo ${V-d}`, "d\n"},
+		{"default expands word", `D=w; echo ${V:-$D}`, "w\n"},
+		{"assign set", `V=x; echo ${V:=d} $V`, "x x\n"},
+		{"assign unset", `echo ${V:=d} $V`, "d d\n"},
+		{"assign empty", `V=; echo ${V:=d} $V`, "d d\n"},
+		{"assign empty without colon", `V=; echo "[${V=d}]" "[$V]"`, "[] []\n"},
+		{"alternate set", `V=x; echo ${V:+a}`, "a\n"},
+		{"alternate unset", `echo "[${V:+a}]"`, "[]\n"},
+		{"alternate empty", `V=; echo "[${V:+a}]"`, "[]\n"},
+		{"alternate empty without colon", `V=; echo ${V+a}`, "a\n"},
+		{"error set", `V=x; echo ${V:?msg}`, "x\n"},
+		{"error unset", `echo ${V:?msg}; echo $?`, "1\n"},
+		{"error empty", `V=; echo ${V:?msg}; echo $?`, "1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+
+}
+
+func TestParamDefaultErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"message", `echo ${V:?msg}`, "V: msg"},
+		{"no message", `echo ${V:?}`, "V: parameter null or not set"},
+		{"empty", `V=; echo ${V:?}`, "V: parameter null or not set"},
+		{"assign positional", `echo ${1:=d}`, "$1: cannot assign in this way"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src+"; echo $?")
+			if out != "1\n" || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want status 1 and %q", tt.src, out, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestDynamicVars(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"random range", `for ((i = 0; i < 20; i++)); do [ $RANDOM -ge 0 -a $RANDOM -le 32767 ] ? true : echo out of range; done`, ""},
+		{"random seed", `RANDOM=5; a=$RANDOM; b=$RANDOM; RANDOM=5; [ $a = $RANDOM ]; echo $?; [ $b = $RANDOM ]; echo $?`, "0\n0\n"},
+		{"seconds assign", `SECONDS=100; echo $SECONDS`, "100\n"},
+		{"seconds increase", `s=$SECONDS; sleep 1.1; [ $SECONDS -gt $s ]; echo $?`, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+
+	// $RANDOMは読むたびに変わる
+	out, _, _ := runShell(t, `echo $RANDOM $RANDOM $RANDOM $RANDOM $RANDOM`)
+	seen := map[string]bool{}
+	for _, f := range strings.Fields(out) {
+		seen[f] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("$RANDOM did not vary: %q", out)
+	}
+	// 別のシェルは別の値から始まる
+	a, _, _ := runShell(t, `echo $RANDOM $RANDOM $RANDOM`)
+	b, _, _ := runShell(t, `echo $RANDOM $RANDOM $RANDOM`)
+	if a == b {
+		t.Errorf("two shells gave the same $RANDOM values %q", a)
+	}
+
+	if out, _, _ := runMain(t, "echo $LINENO\n\necho $LINENO\n"); out != "1\n3\n" {
+		t.Errorf("$LINENO: got %q, want %q", out, "1\n3\n")
+	}
+}
+
+func TestSpecialParams(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name, src, out string
+	}{
+		{"pid", `echo $$`, pid + "\n"},
+		{"pid in pipeline", `echo $$ | cat`, pid + "\n"},
+		{"pid in subshell", `( echo $$ )`, pid + "\n"},
+		{"pid braces", `echo ${$}`, pid + "\n"},
+		{"no background job", `echo "[$!]"`, "[]\n"},
+		{"no background job default", `echo ${!:-none}`, "none\n"},
+		{"name", `echo $0`, "toyshell\n"},
+		{"name in function", `f() { echo $0; }; f`, "toyshell\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+
+	// 子プロセスの親は$$のシェル
+	out, _, _ := runMain(t, "echo $$\nsh -c 'echo $PPID'\n")
+	if lines := strings.Split(out, "\n"); len(lines) < 2 || lines[0] == "" || lines[0] != lines[1] {
+		t.Errorf("$$ and child's $PPID: got %q", out)
+	}
+	if out, _, _ := runMain(t, "", "-c", "echo $0 $1", "name", "arg"); out != "name arg\n" {
+		t.Errorf("-c $0: got %q, want %q", out, "name arg\n")
+	}
+}
+
+func TestNounset(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"default", `set -u; echo ${FOO:-d} ${FOO-e}`, "d e\n"},
+		{"alternate", `set -u; echo "[${FOO:+x}]" "[${FOO+x}]"`, "[] []\n"},
+		{"assign", `set -u; echo ${FOO:=a} $FOO`, "a a\n"},
+		{"set variable", `set -u; FOO=1; echo $FOO`, "1\n"},
+		{"empty variable", `set -u; FOO=; echo "[$FOO]"`, "[]\n"},
+		{"all parameters", `set -u; echo "[$@]" "[$*]" $#`, "[] [] 0\n"},
+		{"status and pid", `set -u; echo $? ${$:+pid}`, "0 pid\n"},
+		{"array elements", `set -u; a=(); echo "[${a[@]}]" ${#a[@]}`, "[] 0\n"},
+		{"environment", `set -u; echo ${HOME:+home}`, "home\n"},
+		{"turned off", `set -u; set +u; echo "[$FOO]"`, "[]\n"},
+		{"long option", `set -o nounset; echo ${FOO:-d}`, "d\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestNounsetErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"variable", `echo a $FOO`, "FOO: unbound variable"},
+		{"braces", `echo ${FOO}`, "FOO: unbound variable"},
+		{"length", `echo ${#FOO}`, "FOO: unbound variable"},
+		{"substring", `echo ${FOO:1}`, "FOO: unbound variable"},
+		{"pattern removal", `echo ${FOO#x}`, "FOO: unbound variable"},
+		{"positional", `f() { echo $1; }; f`, "1: unbound variable"},
+		{"array element", `a=(x); echo ${a[3]}`, "a[3]: unbound variable"},
+		{"background pid", `echo $!`, "!: unbound variable"},
+		{"long option", `set +u; set -o nounset; echo $FOO`, "FOO: unbound variable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// スクリプトはエラーで終了し、次のコマンドを実行しない
+			out, errOut, status := runShell(t, "set -u; "+tt.src+"; echo after")
+			if out != "" || status != 1 || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q, status %d (stderr %q), want status 1 and %q", tt.src, out, status, errOut, tt.err)
+			}
+		})
+	}
+
+	// 次の行も実行しない
+	out, errOut, status := runMain(t, "set -u\necho $FOO\necho after\n")
+	if out != "" || status != 1 || !strings.Contains(errOut, "line 2: FOO: unbound variable") {
+		t.Errorf("script: got %q, status %d (stderr %q)", out, status, errOut)
+	}
+
+	// 対話モードではエラーにするだけで続ける
+	out, errOut, _ = runShellSetup(t, "set -u; echo $FOO; echo $?; echo after", "", func(sh *Shell) { sh.Interactive = true })
+	if out != "1\nafter\n" || !strings.Contains(errOut, "FOO: unbound variable") {
+		t.Errorf("interactive: got %q (stderr %q)", out, errOut)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+	${...}のパラメータ展開
+*/
+// ${...}の中身を変数名と演算子と単語に分ける
+// 例: "VAR:-default" -> "VAR", ":-", "default"
+// ${#VAR}は演算子"#"の後に変数名を返す
+func splitParam(expr string) (name, op, word string) {
+	if len(expr) > 1 && expr[0] == '#' {
+		return "", "#", expr[1:]
+	}
+	// ${!NAME[@]}は演算子"!"の後に配列名を返す
+	if len(expr) > 1 && expr[0] == '!' && allElements(expr[1:]) {
+		return "", "!", expr[1:]
+	}
+
+	i := 0
+	switch {
+	case expr == "":
+	case strings.IndexByte("@*#?$!", expr[0]) >= 0:
+		i = 1
+	case '0' <= expr[0] && expr[0] <= '9':
+		for i < len(expr) && '0' <= expr[i] && expr[i] <= '9' {
+			i++
+		}
+	default:
+		for i < len(expr) && IsName(expr[:i+1]) {
+			i++
+		}
+		// NAME[subscript]
+		if i < len(expr) && expr[i] == '[' {
+			if j := strings.IndexByte(expr[i:], ']'); j != -1 {
+				i += j + 1
+			}
+		}
+	}
+	name, rest := expr[:i], expr[i:]
+
+	ops := []string{":-", ":=", ":+", ":?", ":", "-", "=", "+", "?", "##", "#", "%%", "%"}
+	for _, o := range ops {
+		if strings.HasPrefix(rest, o) {
+			return name, o, rest[len(o):]
+		}
+	}
+	return name, rest, ""
+}
+
+// ${name<op>word}を評価する
+func (sh *Shell) Param(name, op, word string) (string, error) {
+	// ${#VAR}
+	if name == "" && op == "#" {
+		if word == "@" || word == "*" {
+			return strconv.Itoa(len(sh.Args)), nil
+		}
+		// ${#NAME[@]}は要素数
+		if allElements(word) {
+			base, _, _ := splitSubscript(word)
+			return strconv.Itoa(len(sh.Elements(base))), nil
+		}
+		v, set := sh.Lookup(word)
+		if err := sh.checkSet(word, set); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(utf8.RuneCountInString(v)), nil
+	}
+
+	// ${!NAME[@]}は添字の一覧
+	if name == "" && op == "!" {
+		base, _, _ := splitSubscript(word)
+		return strings.Join(sh.Keys(base), " "), nil
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("${%s%s}: bad substitution", op, word)
+	}
+	v, set := sh.Lookup(name)
+	if op == "" {
+		return v, sh.checkSet(name, set)
+	}
+
+	// ${VAR:-word}などの未設定の場合を扱う演算子以外はset -uで調べる
+	switch op {
+	case ":", "#", "##", "%", "%%":
+		if err := sh.checkSet(name, set); err != nil {
+			return "", err
+		}
+	}
+
+	switch op {
+	// ${VAR:offset:length}
+	// offsetとlengthには${n}のような変数を書ける
+	case ":":
+		spec, err := sh.ExpandVars(word)
+		if err != nil {
+			return "", err
+		}
+		return Substr(v, spec)
+	// ${VAR#pat}, ${VAR%pat}など
+	case "#", "##", "%", "%%":
+		pat, err := sh.ExpandPattern(word)
+		if err != nil {
+			return "", err
+		}
+		if op[0] == '#' {
+			return TrimPrefixPattern(v, pat, len(op) == 2), nil
+		}
+		return TrimSuffixPattern(v, pat, len(op) == 2), nil
+	}
+
+	// :付きの演算子は空文字列も未設定として扱う
+	unset := !set
+	if op[0] == ':' {
+		unset = !set || v == ""
+	}
+
+	switch op {
+	case ":-", "-":
+		if unset {
+			return sh.ExpandVars(word)
+		}
+	case ":=", "=":
+		if unset {
+			if !IsName(name) {
+				return "", fmt.Errorf("$%s: cannot assign in this way", name)
+			}
+			w, err := sh.ExpandVars(word)
+			if err != nil {
+				return "", err
+			}
+			if err := sh.SetVar(name, w); err != nil {
+				return "", err
+			}
+			return sh.Get(name), nil
+		}
+	case ":+", "+":
+		if unset {
+			return "", nil
+		}
+		return sh.ExpandVars(word)
+	case ":?", "?":
+		if unset {
+			msg, err := sh.ExpandVars(word)
+			if err != nil {
+				return "", err
+			}
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, msg)
+		}
+	default:
+		return "", fmt.Errorf("${%s%s}: bad substitution", name, op)
+	}
+	return v, nil
+}
+
+// set -uのとき、未設定の変数の展開をエラーにする
+// $@と${NAME[@]}は対象外
+// 対話モードでなければエラーを出してからExitControlを返し、シェルを終了する
+func (sh *Shell) checkSet(name string, set bool) error {
+	if set || !sh.Options["nounset"] {
+		return nil
+	}
+	if name == "@" || name == "*" || allElements(name) {
+		return nil
+	}
+	err := fmt.Errorf("%s: unbound variable", name)
+	if !sh.Interactive {
+		sh.Error(err)
+		return &ExitControl{Status: 1}
+	}
+	return err
+}
+
+// ${VAR:offset:length}の部分文字列を取り出す
+// offsetが負なら末尾から数え、lengthが負なら末尾からその文字数を除く
+// 範囲外の値は文字列の範囲に収める
+func Substr(v, spec string) (string, error) {
+	offStr, lenStr, hasLen := strings.Cut(spec, ":")
+	r := []rune(v)
+
+	off, err := parseOffset(offStr)
+	if err != nil {
+		return "", err
+	}
+	if off < 0 {
+		off += len(r)
+	}
+	off = clamp(off, 0, len(r))
+
+	end := len(r)
+	if hasLen {
+		n, err := parseOffset(lenStr)
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			end = len(r) + n
+		} else {
+			end = off + n
+		}
+		end = clamp(end, off, len(r))
+	}
+	return string(r[off:end]), nil
+}
+
+// 空白と()を取り除いて整数にする
+// 空なら0
+func parseOffset(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = strings.TrimSpace(s[1 : len(s)-1])
+	}
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: bad substring expression", s)
+	}
+	return n, nil
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
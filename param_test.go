@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitParam(t *testing.T) {
+	tests := []struct {
+		expr, name, op, word string
+	}{
+		{"VAR", "VAR", "", ""},
+		{"VAR:-default", "VAR", ":-", "default"},
+		{"VAR-default", "VAR", "-", "default"},
+		{"VAR:=x", "VAR", ":=", "x"},
+		{"VAR:+x", "VAR", ":+", "x"},
+		{"VAR:?msg", "VAR", ":?", "msg"},
+		{"VAR:1:2", "VAR", ":", "1:2"},
+		{"VAR: -1", "VAR", ":", " -1"},
+		{"#VAR", "", "#", "VAR"},
+		{"#", "#", "", ""},
+		{"#@", "", "#", "@"},
+		{"VAR#*/", "VAR", "#", "*/"},
+		{"VAR##*/", "VAR", "##", "*/"},
+		{"VAR%.go", "VAR", "%", ".go"},
+		{"VAR%%.*", "VAR", "%%", ".*"},
+		{"10:-x", "10", ":-", "x"},
+		{"@:1", "@", ":", "1"},
+		{"arr[1]:-x", "arr[1]", ":-", "x"},
+		{"!arr[@]", "", "!", "arr[@]"},
+		{"VAR/a/b", "VAR", "/a/b", ""},
+	}
+	for _, tt := range tests {
+		name, op, word := splitParam(tt.expr)
+		if name != tt.name || op != tt.op || word != tt.word {
+			t.Errorf("splitParam(%q) = %q, %q, %q, want %q, %q, %q", tt.expr, name, op, word, tt.name, tt.op, tt.word)
+		}
+	}
+}
+
+func TestSubstr(t *testing.T) {
+	tests := []struct {
+		v, spec, want string
+	}{
+		{"abcdef", "2", "cdef"},
+		{"abcdef", "2:3", "cde"},
+		{"abcdef", "0:0", ""},
+		{"abcdef", ":2", "ab"},
+		{"abcdef", " -2", "ef"},
+		{"abcdef", "(-2)", "ef"},
+		{"abcdef", " -4:2", "cd"},
+		{"abcdef", "1:-2", "bcd"},
+		{"abcdef", "4:-3", ""},
+		{"abcdef", "10", ""},
+		{"abcdef", "2:100", "cdef"},
+		{"abcdef", " -10", "abcdef"},
+		{"abcdef", " -10:2", "ab"},
+		{"abcdef", "1:-10", ""},
+		{"", "1:2", ""},
+		{"あいうえお", "1:2", "いう"},
+	}
+	for _, tt := range tests {
+		got, err := Substr(tt.v, tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("Substr(%q, %q) = %q, %v, want %q", tt.v, tt.spec, got, err, tt.want)
+		}
+	}
+
+	if _, err := Substr("abc", "x"); err == nil || !strings.Contains(err.Error(), "bad substring expression") {
+		t.Errorf("Substr(\"abc\", \"x\"): got error %v", err)
+	}
+}
+
+func TestParamLength(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"length", `V=hello; echo ${#V}`, "5\n"},
+		{"empty", `V=; echo ${#V}`, "0\n"},
+		{"unset", `echo ${#V}`, "0\n"},
+		{"multibyte", `V=あいう; echo ${#V}`, "3\n"},
+		{"positional count", `f() { echo ${#@} ${#*}; }; f a b c`, "3 3\n"},
+		{"array length", `a=(x y z); echo ${#a[@]}`, "3\n"},
+		{"substring", `V=abcdef; echo ${V:1:3} ${V: -2} ${V:(-3):2}`, "bcd ef de\n"},
+		{"substring variable offset", `V=abcdef; n=2; echo ${V:$n:2}`, "cd\n"},
+		{"substring out of range", `V=abc; echo "[${V:5}]" "[${V:1:100}]"`, "[] [bc]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+/*
+	${VAR#pat}などで使うパターンマッチ
+*/
+// 文字列全体がパターンに一致するか
+// ファイル名展開と違い、*は/にも一致する
+func MatchPattern(pat, s string) bool {
+	return matchRunes([]rune(pat), []rune(s))
+}
+
+func matchRunes(p, s []rune) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 0 && p[0] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchRunes(p, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			ok, n := matchClass(p, s[0])
+			// 閉じていない[は普通の文字として扱う
+			if n == 0 {
+				if s[0] != '[' {
+					return false
+				}
+				p, s = p[1:], s[1:]
+				continue
+			}
+			if !ok {
+				return false
+			}
+			p, s = p[n:], s[1:]
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+			p, s = p[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// [abc]や[!a-z]にcが一致するか
+// nは]の次の位置 (閉じていなければ0)
+func matchClass(p []rune, c rune) (ok bool, n int) {
+	i := 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	first := true
+	for ; i < len(p); i++ {
+		if p[i] == ']' && !first {
+			return ok != negate, i + 1
+		}
+		first = false
+
+		lo := p[i]
+		if lo == '\\' && i+1 < len(p) {
+			i++
+			lo = p[i]
+		}
+		hi := lo
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			hi = p[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			ok = true
+		}
+	}
+	return false, 0
+}
+
+// パターンに一致する先頭部分を取り除く
+// longestなら最長一致、そうでなければ最短一致
+func TrimPrefixPattern(v, pat string, longest bool) string {
+	r := []rune(v)
+	for k := 0; k <= len(r); k++ {
+		i := k
+		if longest {
+			i = len(r) - k
+		}
+		if MatchPattern(pat, string(r[:i])) {
+			return string(r[i:])
+		}
+	}
+	return v
+}
+
+// パターンに一致する末尾部分を取り除く
+func TrimSuffixPattern(v, pat string, longest bool) string {
+	r := []rune(v)
+	for k := 0; k <= len(r); k++ {
+		i := len(r) - k
+		if longest {
+			i = k
+		}
+		if MatchPattern(pat, string(r[i:])) {
+			return string(r[:i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestTrimPattern(t *testing.T) {
+	tests := []struct {
+		v, pat          string
+		prefix, longest bool
+		want            string
+	}{
+		{"a/b/c.go", "*/", true, false, "b/c.go"},
+		{"a/b/c.go", "*/", true, true, "c.go"},
+		{"a/b/c.go", ".*", false, false, "a/b/c"},
+		{"file.tar.gz", ".*", false, false, "file.tar"},
+		{"file.tar.gz", ".*", false, true, "file"},
+		{"a/b/c.go", "/*", false, false, "a/b"},
+		{"a/b/c.go", "/*", false, true, "a"},
+		{"abc", "x", true, false, "abc"},
+		{"abc", "x", false, true, "abc"},
+		{"abc", "*", true, false, "abc"},
+		{"abc", "*", true, true, ""},
+		{"abc", "*", false, false, "abc"},
+		{"abc", "*", false, true, ""},
+		{"aab", "a?", true, false, "b"},
+		{"abc", "[ab]", true, false, "bc"},
+		{"ab*", `\*`, false, false, "ab"},
+		{"abc", `\*`, false, false, "abc"},
+		{"x.go", `.go`, false, false, "x"},
+		{"あいう", "あ", true, false, "いう"},
+		{"", "*", true, true, ""},
+	}
+	for _, tt := range tests {
+		trim := TrimSuffixPattern
+		if tt.prefix {
+			trim = TrimPrefixPattern
+		}
+		if got := trim(tt.v, tt.pat, tt.longest); got != tt.want {
+			t.Errorf("trim(%q, %q, prefix=%v, longest=%v) = %q, want %q", tt.v, tt.pat, tt.prefix, tt.longest, got, tt.want)
+		}
+	}
+}
+
+func TestPatternRemoval(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"basename", `p=/usr/local/bin/go; echo ${p##*/}`, "go\n"},
+		{"shortest prefix", `p=/usr/local/bin/go; echo ${p#*/}`, "usr/local/bin/go\n"},
+		{"dirname", `p=/usr/local/bin/go; echo ${p%/*}`, "/usr/local/bin\n"},
+		{"longest suffix", `p=/usr/local/bin/go; echo "[${p%%/*}]"`, "[]\n"},
+		{"extension", `f=main.go; echo ${f%.go}`, "main\n"},
+		{"no match", `f=main.go; echo ${f%.c}`, "main.go\n"},
+		{"pattern from variable", `f=main.go; ext=.go; echo ${f%$ext}`, "main\n"},
+		{"quoted pattern", `f='a*b'; echo ${f#"a*"}`, "b\n"},
+		{"unset", `echo "[${f#x}]"`, "[]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	printf組み込みコマンド
+*/
+// printf format [arguments...]
+// 引数が余ったらformatを繰り返し使う
+// 数値にできない引数や不正な変換指定は警告して1を返す
+func Printf(ca *CmdArg, args []string) (int, error) {
+	if len(args) < 2 {
+		return 2, fmt.Errorf("printf: usage: printf format [arguments]")
+	}
+
+	p := printer{sh: ca.Sh, args: args[2:]}
+	for {
+		if !p.format(args[1]) {
+			break
+		}
+		// 引数を使わないformatは1回だけ
+		if len(p.args) == 0 || !p.used {
+			break
+		}
+		p.used = false
+	}
+
+	if _, err := fmt.Fprint(ca.Sh.Out, p.out.String()); err != nil {
+		return 1, fmt.Errorf("printf: %w", err)
+	}
+	return p.status, nil
+}
+
+type printer struct {
+	sh     *Shell
+	args   []string // まだ使っていない引数
+	used   bool     // formatで引数を使ったか
+	status int
+	out    strings.Builder
+}
+
+// formatを1回出力する
+// 続けられないエラーがあればfalse
+func (p *printer) format(f string) bool {
+	for i := 0; i < len(f); i++ {
+		switch c := f[i]; c {
+		case '\\':
+			s, n := unescape(f[i:], false)
+			p.out.WriteString(s)
+			i += n - 1
+		case '%':
+			if i+1 < len(f) && f[i+1] == '%' {
+				p.out.WriteByte('%')
+				i++
+				continue
+			}
+			n, ok := p.conv(f[i:])
+			if !ok {
+				return false
+			}
+			i += n - 1
+		default:
+			p.out.WriteByte(c)
+		}
+	}
+	return true
+}
+
+// %[flags][width][.precision]verbを1つ出力する
+// nは読んだバイト数
+func (p *printer) conv(f string) (n int, ok bool) {
+	j := 1
+	for j < len(f) && strings.IndexByte("-+ #0", f[j]) >= 0 {
+		j++
+	}
+	for j < len(f) && '0' <= f[j] && f[j] <= '9' {
+		j++
+	}
+	if j < len(f) && f[j] == '.' {
+		j++
+		for j < len(f) && '0' <= f[j] && f[j] <= '9' {
+			j++
+		}
+	}
+	if j >= len(f) {
+		p.warn(fmt.Errorf("printf: `%s': missing format character", f))
+		return 0, false
+	}
+
+	spec, verb := f[:j], f[j]
+	switch verb {
+	case 's':
+		fmt.Fprintf(&p.out, spec+"s", p.next())
+	case 'b':
+		s, _ := unescape(p.next(), true)
+		fmt.Fprintf(&p.out, spec+"s", s)
+	case 'c':
+		if a := p.next(); a != "" {
+			fmt.Fprintf(&p.out, spec+"s", string([]rune(a)[0]))
+		}
+	case 'd', 'i':
+		fmt.Fprintf(&p.out, spec+"d", p.number())
+	case 'u', 'x', 'X', 'o':
+		if verb == 'u' {
+			verb = 'd'
+		}
+		fmt.Fprintf(&p.out, spec+string(verb), uint64(p.number()))
+	default:
+		p.warn(fmt.Errorf("printf: `%c': invalid format character", verb))
+		return 0, false
+	}
+	return j + 1, true
+}
+
+// 次の引数 (なければ空文字列)
+func (p *printer) next() string {
+	p.used = true
+	if len(p.args) == 0 {
+		return ""
+	}
+	a := p.args[0]
+	p.args = p.args[1:]
+	return a
+}
+
+// 次の引数を数値にする
+// 'cや"cは文字コードになる
+func (p *printer) number() int64 {
+	a := p.next()
+	if a == "" {
+		return 0
+	}
+	if a[0] == '\'' || a[0] == '"' {
+		if len(a) == 1 {
+			return 0
+		}
+		return int64([]rune(a[1:])[0])
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(a), 0, 64)
+	if err != nil {
+		p.warn(fmt.Errorf("printf: %s: invalid number", a))
+	}
+	return n
+}
+
+func (p *printer) warn(err error) {
+	p.sh.Error(err)
+	p.status = 1
+}
+
+// \で始まるエスケープシーケンスを1つ変換する
+// nは読んだバイト数。%bの引数 (arg) では\0NNNの8進数を使う
+func unescape(s string, arg bool) (string, int) {
+	if arg {
+		// %bの引数全体を変換する
+		var sb strings.Builder
+		for i := 0; i < len(s); i++ {
+			if s[i] != '\\' {
+				sb.WriteByte(s[i])
+				continue
+			}
+			// \cで出力を打ち切る
+			if strings.HasPrefix(s[i:], `\c`) {
+				break
+			}
+			e, n := unescapeOne(s[i:], true)
+			sb.WriteString(e)
+			i += n - 1
+		}
+		return sb.String(), len(s)
+	}
+	return unescapeOne(s, false)
+}
+
+func unescapeOne(s string, arg bool) (string, int) {
+	if len(s) < 2 {
+		return s, len(s)
+	}
+	switch c := s[1]; c {
+	case 'n':
+		return "\n", 2
+	case 't':
+		return "\t", 2
+	case 'r':
+		return "\r", 2
+	case 'a':
+		return "\a", 2
+	case 'b':
+		return "\b", 2
+	case 'f':
+		return "\f", 2
+	case 'v':
+		return "\v", 2
+	case '\\':
+		return "\\", 2
+	case '"', '\'':
+		return string(c), 2
+	case 'x':
+		j := 2
+		for j < len(s) && j < 4 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) >= 0 {
+			j++
+		}
+		if j == 2 {
+			return s[:2], 2
+		}
+		v, _ := strconv.ParseUint(s[2:j], 16, 8)
+		return string([]byte{byte(v)}), j
+	}
+
+	// 8進数 (formatでは\NNN、%bの引数では\0NNN)
+	start := 1
+	if arg {
+		if s[1] != '0' {
+			return s[:2], 2
+		}
+		start = 2
+	}
+	j := start
+	for j < len(s) && j < start+3 && '0' <= s[j] && s[j] <= '7' {
+		j++
+	}
+	if j == start {
+		if arg {
+			return "\x00", 2
+		}
+		return s[:2], 2
+	}
+	v, _ := strconv.ParseUint(s[start:j], 8, 8)
+	return string([]byte{byte(v)}), j
+}
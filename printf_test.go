@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintf(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"string and number", `printf '%s=%d\n' name 42`, "name=42\n"},
+		{"hex", `printf '%x %X %o\n' 255 255 8`, "ff FF 10\n"},
+		{"char", `printf '%c%c\n' abc d`, "ad\n"},
+		{"percent", `printf '100%%\n'`, "100%\n"},
+		{"width and precision", `printf '[%5s][%-5s][%.2s][%03d]\n' a b xyz 7`, "[    a][b    ][xy][007]\n"},
+		{"recycle", `printf '%s\n' a b c`, "a\nb\nc\n"},
+		{"recycle pairs", `printf '%s=%s;' a 1 b 2`, "a=1;b=2;"},
+		{"missing arguments", `printf '%s-%s-%d\n' a`, "a--0\n"},
+		{"no conversions", `printf 'x\n' a b`, "x\n"},
+		{"char code", `printf '%d %d\n' "'A" '"a'`, "65 97\n"},
+		{"hex number argument", `printf '%d\n' 0x10`, "16\n"},
+		{"escapes", `printf 'a\tb\\c\n'`, "a\tb\\c\n"},
+		{"octal and hex escapes", `printf '\101\x42\n'`, "AB\n"},
+		{"unknown escape", `printf '\q\n'`, "\\q\n"},
+		{"b argument", `printf '%b|%s\n' 'a\nb' 'a\nb'`, "a\nb|a\\nb\n"},
+		{"b octal", `printf '%b\n' '\0101'`, "A\n"},
+		{"b stops at c", `printf '%b' 'a\cb'; echo`, "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestPrintfErrors(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"invalid number", `printf '%d\n' abc`, "0\n1\n", "abc: invalid number"},
+		{"invalid format character", `printf 'a%zb\n'`, "a1\n", "`z': invalid format character"},
+		{"missing format character", `printf 'a%5'`, "a1\n", "missing format character"},
+		{"usage", `printf`, "2\n", "printf: usage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src+"; echo $?")
+			if out != tt.out || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want %q and %q", tt.src, out, errOut, tt.out, tt.err)
+			}
+		})
+	}
+}
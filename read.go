@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+)
+
+/*
+	read、mapfile組み込みコマンド
+*/
+// タイムアウトしたときの終了ステータス (SIGALRMで終了したのと同じ)
+const readTimeoutStatus = 128 + int(syscall.SIGALRM)
+
+// read [-r] [-t timeout] [-n nchars] [name...]
+// 1行読んで空白で分割し、nameに順に入れる (最後のnameには残り全部)
+// nameがなければREPLYに入れる。EOFなら1、タイムアウトなら142を返す
+func Read(ca *CmdArg, args []string) (int, error) {
+	var (
+		raw     bool
+		nchars  int
+		timeout time.Duration
+	)
+
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-"; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		switch args[i] {
+		case "-r":
+			raw = true
+		case "-t", "-n":
+			if i+1 >= len(args) {
+				return 2, fmt.Errorf("read: %s: option requires an argument", args[i])
+			}
+			i++
+			if args[i-1] == "-t" {
+				sec, err := strconv.ParseFloat(args[i], 64)
+				if err != nil || sec < 0 {
+					return 1, fmt.Errorf("read: %s: invalid timeout specification", args[i])
+				}
+				timeout = time.Duration(sec * float64(time.Second))
+			} else {
+				n, err := strconv.Atoi(args[i])
+				if err != nil || n < 0 {
+					return 1, fmt.Errorf("read: %s: invalid number", args[i])
+				}
+				nchars = n
+			}
+		default:
+			return 2, fmt.Errorf("read: %s: invalid option", args[i])
+		}
+	}
+
+	names := args[i:]
+	if len(names) == 0 {
+		names = []string{"REPLY"}
+	}
+	for _, name := range names {
+		if !IsName(name) {
+			return 1, fmt.Errorf("read: `%s': not a valid identifier", name)
+		}
+	}
+
+	// -nなら端末でも改行を待たずに読めるようにする
+	in := ca.Sh.In
+	if nchars > 0 {
+		if restore, ok := noncanonical(in); ok {
+			defer restore()
+		}
+	}
+
+	r := lineReader{f: in, raw: raw, nchars: nchars}
+	if timeout > 0 {
+		r.deadline = time.Now().Add(timeout)
+	}
+	line, err := r.read()
+	status := 0
+	switch {
+	case err == errReadTimeout:
+		status = readTimeoutStatus
+	case err == io.EOF:
+		status = 1
+	case err != nil:
+		return 1, fmt.Errorf("read: %w", err)
+	}
+
+	// nameがなければ前後の空白も含めてREPLYに入れる
+	if len(args[i:]) == 0 {
+		if err := ca.Sh.SetVar("REPLY", line); err != nil {
+			return 1, fmt.Errorf("read: %w", err)
+		}
+		return status, nil
+	}
+	for k, name := range names {
+		line = strings.TrimLeft(line, " \t\n")
+		var v string
+		if k == len(names)-1 {
+			v = strings.TrimRight(line, " \t\n")
+		} else {
+			j := strings.IndexAny(line, " \t\n")
+			if j == -1 {
+				j = len(line)
+			}
+			v, line = line[:j], line[j:]
+		}
+		if err := ca.Sh.SetVar(name, v); err != nil {
+			return 1, fmt.Errorf("read: %w", err)
+		}
+	}
+	return status, nil
+}
+
+// mapfile [-t] [-n count] [array] / readarray
+// 1行ずつ配列の要素にする (arrayがなければMAPFILE)
+// -tなら行末の改行を取り除き、-nならcount行まで読む (0なら全部)
+func Mapfile(ca *CmdArg, args []string) (int, error) {
+	name := args[0]
+	trim := false
+	count := 0
+
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-"; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		switch args[i] {
+		case "-t":
+			trim = true
+		case "-n":
+			if i+1 >= len(args) {
+				return 2, fmt.Errorf("%s: -n: option requires an argument", name)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 0 {
+				return 1, fmt.Errorf("%s: %s: invalid line count", name, args[i])
+			}
+			count = n
+		default:
+			return 2, fmt.Errorf("%s: %s: invalid option", name, args[i])
+		}
+	}
+
+	array := "MAPFILE"
+	switch rest := args[i:]; len(rest) {
+	case 0:
+	case 1:
+		array = rest[0]
+	default:
+		return 2, fmt.Errorf("%s: too many arguments", name)
+	}
+	if !IsName(array) {
+		return 1, fmt.Errorf("%s: `%s': not a valid identifier", name, array)
+	}
+
+	r := lineReader{f: ca.Sh.In, raw: true}
+	lines := []string{}
+	for count == 0 || len(lines) < count {
+		line, err := r.read()
+		if err == io.EOF {
+			// 改行で終わっていない最後の行
+			if line != "" {
+				lines = append(lines, line)
+			}
+			break
+		}
+		if err != nil {
+			return 1, fmt.Errorf("%s: %w", name, err)
+		}
+		if !trim {
+			line += "\n"
+		}
+		lines = append(lines, line)
+	}
+
+	if err := ca.Sh.AssignArray(array, lines); err != nil {
+		return 1, fmt.Errorf("%s: %w", name, err)
+	}
+	return 0, nil
+}
+
+var errReadTimeout = errors.New("timed out")
+
+// 入力を1バイトずつ読む
+// 必要な分だけ読むので、続きは後のコマンドが読める
+type lineReader struct {
+	f        *os.File
+	raw      bool      // \をエスケープとして扱わない
+	nchars   int       // この文字数を読んだら改行がなくても終わる (0なら無制限)
+	deadline time.Time // これを過ぎたらタイムアウト (ゼロ値なら無制限)
+}
+
+// 改行かnchars文字まで読む (改行は含まない)
+// 改行の前にEOFになったら、それまでに読んだ文字列とio.EOFを返す
+func (r *lineReader) read() (string, error) {
+	var sb strings.Builder
+	var pending []byte
+	count := 0
+	for {
+		c, err := r.readByte()
+		if err != nil {
+			return sb.String(), err
+		}
+		if c == '\n' {
+			return sb.String(), nil
+		}
+
+		// \の次の文字はそのまま使い、\と改行は読み飛ばす
+		if c == '\\' && !r.raw {
+			c, err = r.readByte()
+			if err != nil {
+				return sb.String(), err
+			}
+			if c == '\n' {
+				continue
+			}
+		}
+
+		// マルチバイト文字は全部読んでから1文字と数える
+		pending = append(pending, c)
+		if !utf8.FullRune(pending) {
+			continue
+		}
+		sb.Write(pending)
+		pending = pending[:0]
+		count++
+		if r.nchars > 0 && count >= r.nchars {
+			return sb.String(), nil
+		}
+	}
+}
+
+func (r *lineReader) readByte() (byte, error) {
+	if !r.deadline.IsZero() {
+		ok, err := waitReadable(int(r.f.Fd()), time.Until(r.deadline))
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, errReadTimeout
+		}
+	}
+
+	var buf [1]byte
+	n, err := r.f.Read(buf[:])
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return buf[0], err
+}
+
+// fdが読めるようになるまで最大dだけ待つ
+func waitReadable(fd int, d time.Duration) (bool, error) {
+	if d <= 0 {
+		d = 0
+	}
+	for {
+		var set syscall.FdSet
+		bits := int(unsafe.Sizeof(set.Bits[0])) * 8
+		set.Bits[fd/bits] |= 1 << (uint(fd) % uint(bits))
+		tv := syscall.NsecToTimeval(d.Nanoseconds())
+
+		start := time.Now()
+		n, err := syscall.Select(fd+1, &set, nil, nil, &tv)
+		if err == syscall.EINTR {
+			d -= time.Since(start)
+			if d < 0 {
+				d = 0
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return n > 0, nil
+	}
+}
+
+// fが端末か
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	return e == 0
+}
+
+// 端末なら行単位の入力 (ICANON) を一時的に止める
+// 返り値の関数を呼ぶと元に戻る。端末でなければokはfalse
+func noncanonical(f *os.File) (restore func(), ok bool) {
+	fd := f.Fd()
+	var saved syscall.Termios
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&saved))); e != 0 {
+		return nil, false
+	}
+
+	t := saved
+	t.Lflag &^= syscall.ICANON
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+		return nil, false
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&saved)))
+	}, true
+}
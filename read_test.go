@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name, src, input, out string
+	}{
+		{"one name", `read x; echo "[$x]"`, "  hello world  \n", "[hello world]\n"},
+		{"split", `read a b; echo "[$a][$b]"`, "1 2 3\n", "[1][2 3]\n"},
+		{"more names than words", `read a b c; echo "[$a][$b][$c]"`, "1\n", "[1][][]\n"},
+		{"reply keeps spaces", `read; echo "[$REPLY]"`, "  a b  \n", "[  a b  ]\n"},
+		{"backslash continues", `read x; echo "[$x]"`, "a\\\nb\n", "[ab]\n"},
+		{"backslash escapes", `read x; echo "[$x]"`, "a\\ b\n", "[a b]\n"},
+		{"raw", `read -r x; echo "[$x]"`, "a\\b\n", "[a\\b]\n"},
+		{"nchars", `read -n 3 x; echo "[$x]"; read y; echo "[$y]"`, "abcdef\n", "[abc]\n[def]\n"},
+		{"nchars stops at newline", `read -n 5 x; echo "[$x]"`, "ab\ncd\n", "[ab]\n"},
+		{"eof without newline", `read x; echo $? "[$x]"`, "last", "1 [last]\n"},
+		{"eof", `read x; echo $? "[$x]"`, "", "1 []\n"},
+		{"lines in order", `read a; read b; echo $b $a`, "1\n2\n", "2 1\n"},
+		{"from redirect", `echo from file > f; read x < f; echo $x`, "", "from file\n"},
+		{"pipe does not set variable", `x=old; echo new | read x; echo $x`, "", "old\n"},
+		{"timeout", `sleep 0.3 | { read -t 0.1 x; echo $?; }`, "", "142\n"},
+		{"timeout with data", `echo ok | { read -t 1 x; echo $? $x; }`, "", "0 ok\n"},
+		{"integer variable", `declare -i n; read n; echo $n`, "2+3\n", "5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			out, errOut, _ := runShellInput(t, tt.src, tt.input)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+		status   string
+	}{
+		{`read -x v`, "-x: invalid option", "2"},
+		{`read -t`, "option requires an argument", "2"},
+		{`read -t abc v`, "invalid timeout specification", "1"},
+		{`read -n -1 v`, "invalid number", "1"},
+		{`read 1x`, "not a valid identifier", "1"},
+		{`readonly r; read r`, "r: readonly variable", "1"},
+	}
+	for _, tt := range tests {
+		out, errOut, _ := runShellInput(t, tt.src+"; echo $?", "line\n")
+		if out != tt.status+"\n" || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q (stderr %q), want status %s and %q", tt.src, out, errOut, tt.status, tt.err)
+		}
+	}
+}
+
+func TestMapfile(t *testing.T) {
+	lines := "one\ntwo words\n\nfour\n"
+	tests := []struct {
+		name, src, input, out string
+	}{
+		{"keeps newlines", `mapfile arr < f; echo ${#arr[@]}; printf '[%s]' "${arr[@]}"`, "", "4\n[one\n][two words\n][\n][four\n]"},
+		{"trim", `mapfile -t arr < f; echo ${#arr[@]}; printf '[%s]' "${arr[@]}"`, "", "4\n[one][two words][][four]"},
+		{"count", `mapfile -t -n 2 arr < f; printf '[%s]' "${arr[@]}"`, "", "[one][two words]"},
+		{"count zero reads all", `mapfile -t -n 0 arr < f; echo ${#arr[@]}`, "", "4\n"},
+		{"count larger than file", `mapfile -t -n 10 arr < f; echo ${#arr[@]}`, "", "4\n"},
+		{"default array", `mapfile -t < f; echo ${MAPFILE[1]}`, "", "two words\n"},
+		{"readarray", `readarray -t arr < f; echo ${arr[3]}`, "", "four\n"},
+		{"stdin", `mapfile -t arr; echo ${arr[0]} ${arr[1]}`, "a\nb\n", "a b\n"},
+		{"rest stays for next command", `mapfile -t -n 1 arr; read x; echo ${arr[0]} $x`, "a\nb\n", "a b\n"},
+		{"no trailing newline", `printf 'a\nb' > g; mapfile -t arr < g; echo ${#arr[@]} ${arr[1]}`, "", "2 b\n"},
+		{"empty input", `mapfile arr < /dev/null; echo ${#arr[@]}`, "", "0\n"},
+		{"replaces array", `arr=(x y z w v); mapfile -t arr < f; echo ${#arr[@]}`, "", "4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile("f", []byte(lines), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			out, errOut, _ := runShellInput(t, tt.src, tt.input)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestMapfileErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+		status   string
+	}{
+		{`mapfile -x arr`, "-x: invalid option", "2"},
+		{`mapfile -n`, "-n: option requires an argument", "2"},
+		{`mapfile -n x arr`, "x: invalid line count", "1"},
+		{`mapfile a b`, "too many arguments", "2"},
+		{`mapfile 1x`, "not a valid identifier", "1"},
+		{`readonly arr; mapfile arr`, "arr: readonly variable", "1"},
+	}
+	for _, tt := range tests {
+		out, errOut, _ := runShellInput(t, tt.src+"; echo $?", "line\n")
+		if out != tt.status+"\n" || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q (stderr %q), want status %s and %q", tt.src, out, errOut, tt.status, tt.err)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+	test組み込みコマンド
+*/
+// test expr / [ expr ]
+// 式が真なら0、偽なら1、式が正しくなければ2を返す
+func Test(ca *CmdArg, args []string) (int, error) {
+	name := args[0]
+	args = args[1:]
+	if name == "[" {
+		if len(args) == 0 || args[len(args)-1] != "]" {
+			return 2, fmt.Errorf("[: missing `]'")
+		}
+		args = args[:len(args)-1]
+	}
+
+	t := tester{args: args, sh: ca.Sh}
+	ok, err := t.eval()
+	if err != nil {
+		return 2, fmt.Errorf("%s: %w", name, err)
+	}
+	if ok {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// 2つの値を比べる演算子
+var binaryTests = map[string]bool{
+	"=": true, "==": true, "!=": true,
+	"-eq": true, "-ne": true, "-lt": true, "-le": true, "-gt": true, "-ge": true,
+	"-nt": true, "-ot": true,
+}
+
+// 1つの値について調べる演算子
+var unaryTests = map[string]bool{
+	"-z": true, "-n": true,
+	"-e": true, "-f": true, "-d": true, "-r": true, "-w": true, "-x": true,
+	"-s": true, "-L": true, "-h": true, "-p": true,
+}
+
+// 式の構文解析と評価
+// 優先順位は低い方から -o, -a, !, 括弧と各演算子
+type tester struct {
+	args []string
+	pos  int
+	sh   *Shell // ファイルの相対パスはsh.Dirから探す
+}
+
+func (t *tester) eval() (bool, error) {
+	if len(t.args) == 0 {
+		return false, nil
+	}
+	ok, err := t.or()
+	if err != nil {
+		return false, err
+	}
+	if t.pos < len(t.args) {
+		return false, fmt.Errorf("%s: unexpected argument", t.args[t.pos])
+	}
+	return ok, nil
+}
+
+func (t *tester) peek(k int) string {
+	if t.pos+k >= len(t.args) {
+		return ""
+	}
+	return t.args[t.pos+k]
+}
+
+// 残りの引数の数
+func (t *tester) rest() int {
+	return len(t.args) - t.pos
+}
+
+func (t *tester) or() (bool, error) {
+	ok, err := t.and()
+	for err == nil && t.rest() > 1 && t.peek(0) == "-o" {
+		t.pos++
+		var r bool
+		r, err = t.and()
+		ok = ok || r
+	}
+	return ok, err
+}
+
+func (t *tester) and() (bool, error) {
+	ok, err := t.not()
+	for err == nil && t.rest() > 1 && t.peek(0) == "-a" {
+		t.pos++
+		var r bool
+		r, err = t.not()
+		ok = ok && r
+	}
+	return ok, err
+}
+
+func (t *tester) not() (bool, error) {
+	// [ ! = x ]のように!が比較の左辺のときは否定ではない
+	if t.peek(0) == "!" && t.rest() > 1 && !(t.rest() >= 3 && binaryTests[t.peek(1)]) {
+		t.pos++
+		ok, err := t.not()
+		return !ok, err
+	}
+	return t.primary()
+}
+
+func (t *tester) primary() (bool, error) {
+	if t.rest() == 0 {
+		return false, fmt.Errorf("argument expected")
+	}
+
+	// A op B
+	if t.rest() >= 3 && binaryTests[t.peek(1)] {
+		a, op, b := t.peek(0), t.peek(1), t.peek(2)
+		t.pos += 3
+		return t.sh.binaryTest(a, op, b)
+	}
+
+	// ( expr )
+	if t.peek(0) == "(" && t.rest() > 1 {
+		t.pos++
+		ok, err := t.or()
+		if err != nil {
+			return false, err
+		}
+		if t.peek(0) != ")" {
+			return false, fmt.Errorf("`)' expected")
+		}
+		t.pos++
+		return ok, nil
+	}
+
+	// -op A
+	if unaryTests[t.peek(0)] && t.rest() >= 2 {
+		op, a := t.peek(0), t.peek(1)
+		t.pos += 2
+		return t.sh.unaryTest(op, a), nil
+	}
+
+	// 文字列だけなら空でなければ真
+	a := t.peek(0)
+	t.pos++
+	return a != "", nil
+}
+
+// access(2)で調べる権限
+const (
+	accessExec  = 1
+	accessWrite = 2
+	accessRead  = 4
+)
+
+func (sh *Shell) unaryTest(op, a string) bool {
+	switch op {
+	case "-z":
+		return a == ""
+	case "-n":
+		return a != ""
+	}
+
+	p := sh.abs(a)
+	switch op {
+	case "-r":
+		return syscall.Access(p, accessRead) == nil
+	case "-w":
+		return syscall.Access(p, accessWrite) == nil
+	case "-x":
+		return syscall.Access(p, accessExec) == nil
+	case "-L", "-h":
+		fi, err := os.Lstat(p)
+		return err == nil && fi.Mode()&os.ModeSymlink != 0
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "-f":
+		return fi.Mode().IsRegular()
+	case "-d":
+		return fi.IsDir()
+	case "-s":
+		return fi.Size() > 0
+	case "-p":
+		return fi.Mode()&os.ModeNamedPipe != 0
+	}
+	// -e
+	return true
+}
+
+func (sh *Shell) binaryTest(a, op, b string) (bool, error) {
+	switch op {
+	case "=", "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	case "-nt", "-ot":
+		fa, erra := os.Stat(sh.abs(a))
+		fb, errb := os.Stat(sh.abs(b))
+		if op == "-ot" {
+			fa, fb, erra, errb = fb, fa, errb, erra
+		}
+		// 存在しないファイルより存在するファイルの方が新しい
+		if erra != nil {
+			return false, nil
+		}
+		if errb != nil {
+			return true, nil
+		}
+		return fa.ModTime().After(fb.ModTime()), nil
+	}
+
+	x, err := testInt(a)
+	if err != nil {
+		return false, err
+	}
+	y, err := testInt(b)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case "-eq":
+		return x == y, nil
+	case "-ne":
+		return x != y, nil
+	case "-lt":
+		return x < y, nil
+	case "-le":
+		return x <= y, nil
+	case "-gt":
+		return x > y, nil
+	}
+	// -ge
+	return x >= y, nil
+}
+
+func testInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: integer expression expected", s)
+	}
+	return n, nil
+}
+
+/*
+	[[ expr ]]
+*/
+// [[ ... ]]を評価する
+// 単語の分割とファイル名展開をせず、==と!=の右辺はパターン、=~の右辺は正規表現として扱う
+// =~で一致した部分と括弧で囲んだ部分は配列BASH_REMATCHに入れる
+func (sh *Shell) Cond(args []string) (int, error) {
+	if args[len(args)-1] != "]]" {
+		return 2, fmt.Errorf("syntax error: missing `]]'")
+	}
+
+	// パイプとして分けられた||を戻す
+	var toks []string
+	for _, a := range args[1 : len(args)-1] {
+		if a == "|" && len(toks) > 0 && toks[len(toks)-1] == "|" {
+			toks[len(toks)-1] = "||"
+			continue
+		}
+		toks = append(toks, a)
+	}
+
+	c := condTester{tester: tester{args: toks, sh: sh}}
+	if len(toks) == 0 {
+		return 2, fmt.Errorf("syntax error near `]]'")
+	}
+	ok, err := c.or()
+	if err == nil && c.pos < len(c.args) {
+		err = fmt.Errorf("syntax error near `%s'", c.peek(0))
+	}
+	if err != nil {
+		return 2, fmt.Errorf("[[: %w", err)
+	}
+	if ok {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// [[ ]]の中は&&、||、!、括弧で組み合わせる
+type condTester struct {
+	tester
+}
+
+func (c *condTester) or() (bool, error) {
+	ok, err := c.and()
+	for err == nil && c.peek(0) == "||" {
+		c.pos++
+		r, rerr := c.and()
+		ok, err = ok || r, rerr
+	}
+	return ok, err
+}
+
+func (c *condTester) and() (bool, error) {
+	ok, err := c.not()
+	for err == nil && c.peek(0) == "&&" {
+		c.pos++
+		r, rerr := c.not()
+		ok, err = ok && r, rerr
+	}
+	return ok, err
+}
+
+func (c *condTester) not() (bool, error) {
+	if c.peek(0) == "!" {
+		c.pos++
+		ok, err := c.not()
+		return !ok, err
+	}
+	return c.primary()
+}
+
+// 式の区切りの記号か
+func condOperator(tok string) bool {
+	return tok == "" || tok == "&&" || tok == "||" || tok == "(" || tok == ")"
+}
+
+func (c *condTester) primary() (bool, error) {
+	tok := c.peek(0)
+	if tok == "(" {
+		c.pos++
+		ok, err := c.or()
+		if err != nil {
+			return false, err
+		}
+		if c.peek(0) != ")" {
+			return false, fmt.Errorf("`)' expected")
+		}
+		c.pos++
+		return ok, nil
+	}
+	if condOperator(tok) {
+		return false, fmt.Errorf("syntax error near `%s'", tok)
+	}
+
+	// -op A
+	if unaryTests[tok] && !condOperator(c.peek(1)) {
+		a, err := c.sh.ExpandVars(c.peek(1))
+		if err != nil {
+			return false, err
+		}
+		c.pos += 2
+		return c.sh.unaryTest(tok, a), nil
+	}
+
+	a, err := c.sh.ExpandVars(tok)
+	if err != nil {
+		return false, err
+	}
+	op := c.peek(1)
+	if condOperator(op) {
+		c.pos++
+		return a != "", nil
+	}
+
+	switch op {
+	case "=~":
+		c.pos += 2
+		return c.match(a)
+	case "==", "=", "!=":
+		pat, err := c.sh.ExpandPattern(c.peek(2))
+		if err != nil {
+			return false, err
+		}
+		c.pos += 3
+		return MatchPattern(pat, a) == (op != "!="), nil
+	case "<", ">":
+		b, err := c.sh.ExpandVars(c.peek(2))
+		if err != nil {
+			return false, err
+		}
+		c.pos += 3
+		if op == "<" {
+			return a < b, nil
+		}
+		return a > b, nil
+	}
+	if !binaryTests[op] {
+		return false, fmt.Errorf("%s: conditional binary operator expected", op)
+	}
+	b, err := c.sh.ExpandVars(c.peek(2))
+	if err != nil {
+		return false, err
+	}
+	c.pos += 3
+	return c.sh.binaryTest(a, op, b)
+}
+
+// A =~ regexp
+// 正規表現は&&か||か]]までのトークンをつなげたもの
+func (c *condTester) match(a string) (bool, error) {
+	var sb strings.Builder
+	for c.pos < len(c.args) && c.peek(0) != "&&" && c.peek(0) != "||" {
+		w, err := c.sh.ExpandVars(c.peek(0))
+		if err != nil {
+			return false, err
+		}
+		sb.WriteString(w)
+		c.pos++
+	}
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid regular expression", sb.String())
+	}
+
+	m := re.FindStringSubmatch(a)
+	if m == nil {
+		delete(c.sh.Arrays, "BASH_REMATCH")
+		return false, nil
+	}
+	c.sh.SetArray("BASH_REMATCH", m)
+	return true, nil
+}
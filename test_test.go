@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTest(t *testing.T) {
+	setup := `echo data > f; touch e; mkdir d; echo '#!/bin/sh' > x; chmod +x x; ln -s f l; mkfifo p; touch -d 2000-01-01 old; `
+	tests := []struct {
+		name, src string
+		status    int
+	}{
+		{"-e", `test -e f`, 0},
+		{"-e missing", `test -e nothing`, 1},
+		{"-f", `test -f f`, 0},
+		{"-f directory", `test -f d`, 1},
+		{"-d", `test -d d`, 0},
+		{"-d file", `test -d f`, 1},
+		{"-r", `test -r f`, 0},
+		{"-r missing", `test -r nothing`, 1},
+		{"-w", `test -w f`, 0},
+		{"-w missing", `test -w nothing`, 1},
+		{"-x", `test -x x`, 0},
+		{"-x not executable", `test -x f`, 1},
+		{"-s", `test -s f`, 0},
+		{"-s empty", `test -s e`, 1},
+		{"-L", `test -L l`, 0},
+		{"-h file", `test -h f`, 1},
+		{"-p", `test -p p`, 0},
+		{"-p file", `test -p f`, 1},
+		{"-nt", `test f -nt old`, 0},
+		{"-nt older", `test old -nt f`, 1},
+		{"-nt missing", `test f -nt nothing`, 0},
+		{"-ot", `test old -ot f`, 0},
+		{"-z", `test -z ""`, 0},
+		{"-z nonempty", `test -z a`, 1},
+		{"-n", `test -n a`, 0},
+		{"-n empty", `test -n ""`, 1},
+		{"string", `test a`, 0},
+		{"empty string", `test ""`, 1},
+		{"no arguments", `test`, 1},
+		{"=", `a=x; test "$a" = x`, 0},
+		{"= different", `test a = b`, 1},
+		{"==", `test a == a`, 0},
+		{"!=", `test a != b`, 0},
+		{"!= same", `test a != a`, 1},
+		{"-eq", `test 3 -eq 3`, 0},
+		{"-eq different", `test 3 -eq 4`, 1},
+		{"-ne", `test 3 -ne 4`, 0},
+		{"-lt", `test 3 -lt 4`, 0},
+		{"-lt equal", `test 4 -lt 4`, 1},
+		{"-le", `test 4 -le 4`, 0},
+		{"-gt", `n=5; test $n -gt 3`, 0},
+		{"-gt smaller", `test -5 -gt 3`, 1},
+		{"-ge", `test 3 -ge 3`, 0},
+		{"!", `test ! -e nothing`, 0},
+		{"! string", `test ! a`, 1},
+		{"! as operand", `test ! = x`, 1},
+		{"-a", `test -f f -a -d d`, 0},
+		{"-a false", `test -f f -a -d f`, 1},
+		{"-o", `test -d f -o -f f`, 0},
+		{"-o false", `test -d f -o -d e`, 1},
+		{"-a before -o", `test a = b -a x -o c = c`, 0},
+		{"parentheses", `test \( a = b -o x \) -a c = c`, 0},
+		{"bracket", `[ -f f ]`, 0},
+		{"bracket false", `[ 1 -gt 2 ]`, 1},
+		{"relative to cd", `cd d; test -f ../f`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "cd " + t.TempDir() + "; " + setup + tt.src + "; echo $?"
+			out, errOut, _ := runShell(t, src)
+			if want := fmt.Sprintf("%d\n", tt.status); out != want || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, want)
+			}
+		})
+	}
+}
+
+func TestTestErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"missing bracket", `[ a = a`, "[: missing `]'"},
+		{"integer expected", `test a -eq 1`, "test: a: integer expression expected"},
+		{"unexpected argument", `test a b`, "test: b: unexpected argument"},
+		{"unclosed parenthesis", `test \( a`, "test: `)' expected"},
+		{"argument expected", `test a -a`, "test: -a: unexpected argument"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src+"; echo $?")
+			if out != "2\n" || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want status 2 and %q", tt.src, out, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestCond(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"question pattern", `f=a.go; [[ $f == ?.go ]]; echo $?`, "0\n"},
+		{"question no match", `f=ab.go; [[ $f == ?.go ]]; echo $?`, "1\n"},
+		{"colon literal", `t=a:b; [[ $t == a:b ]]; echo $?`, "0\n"},
+		{"colon pattern", `t=a:b; [[ $t == *:* ]]; echo $?`, "0\n"},
+		{"star pattern", `[[ abc == a* ]]; echo $?`, "0\n"},
+		{"quoted pattern", `[[ abc == "a*" ]]; echo $?`, "1\n"},
+		{"not equal", `[[ abc != a* ]]; echo $?`, "1\n"},
+		{"no word splitting", `v="a b"; [[ $v == "a b" ]]; echo $?`, "0\n"},
+		{"empty string", `v=; [[ $v ]]; echo $?`, "1\n"},
+		{"and", `[[ a == a && b == c ]]; echo $?`, "1\n"},
+		{"or", `[[ a == b || b == b ]]; echo $?`, "0\n"},
+		{"not", `[[ ! a == b ]]; echo $?`, "0\n"},
+		{"parentheses", `[[ ( a == b || a == a ) && c == c ]]; echo $?`, "0\n"},
+		{"string order", `[[ abc < abd ]]; echo $?`, "0\n"},
+		{"integer", `[[ 10 -gt 9 ]]; echo $?`, "0\n"},
+		{"regex", `[[ ab12 =~ ^[a-z]+([0-9]+)$ ]]; echo $? ${BASH_REMATCH[1]}`, "0 12\n"},
+		{"regex no match", `[[ ab =~ ^[0-9]+$ ]]; echo $?`, "1\n"},
+		{"ternary", `[[ x == ? ]] ? echo y : echo n`, "y\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestCondErrors(t *testing.T) {
+	tests := []struct {
+		name, src, err string
+	}{
+		{"missing close", `[[ a == a`, "missing `]]'"},
+		{"empty", `[[ ]]`, "syntax error near `]]'"},
+		{"bad regex", `[[ a =~ ( ]]`, "invalid regular expression"},
+		{"bad operator", `[[ a -xx b ]]`, "conditional binary operator expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src+"; echo $?")
+			if out != "2\n" || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want status 2 and %q", tt.src, out, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestPosix(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"cond", `[[ a == a ]]; echo $?`, "127\n", `"[[": executable file not found`},
+		{"input process substitution", `cat <(echo x); echo $?`, "1\n", "syntax error near unexpected token `('"},
+		{"output process substitution", `echo x > >(cat); echo $?`, "1\n", "syntax error near unexpected token `>'"},
+		{"no brace expansion", `echo {a,b} x{1..3}`, "{a,b} x{1..3}\n", ""},
+		{"set +o posix", `set +o posix; [[ a == a ]]; echo $?`, "0\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, "set -o posix; "+tt.src)
+			if out != tt.out || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want %q and %q", tt.src, out, errOut, tt.out, tt.err)
+			}
+		})
+	}
+
+	out, errOut, status := runMain(t, "", "--posix", "-c", "[[ a == a ]]; echo $?; test a = a; echo $?")
+	if out != "127\n0\n" || status != 0 || !strings.Contains(errOut, `"[["`) {
+		t.Errorf("--posix: got %q, status %d (stderr %q)", out, status, errOut)
+	}
+}
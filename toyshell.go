@@ -2,230 +2,1196 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math/rand"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // RunCmdで使う構造体
 type CmdArg struct {
-	Cmd   []string
-	Attr  syscall.ProcAttr
-	SigCh chan os.Signal
+	Cmd  []string
+	Attr syscall.ProcAttr
+	Sh   *Shell
+
+	// リダイレクト先 (組み込みコマンド用)
+	In, Out, Err *os.File
+	Fds          map[int]*os.File // 3以降のファイル記述子
+	opened       []*os.File       // ParseRedirectで開いたファイル
+}
+
+// シェル全体で共有する状態
+type Shell struct {
+	Vars        map[string]string
+	Funcs       map[string]*FuncNode
+	Exported    map[string]bool // exportした変数の名前
+	Arrays      map[string][]string
+	Assoc       map[string]map[string]string // 連想配列 (declare -A)
+	Readonly    map[string]bool              // 代入できない変数
+	Integers    map[string]bool              // 代入した値を算術式として評価する変数 (declare -i)
+	In          *os.File                     // 組み込みコマンドとリダイレクトのデフォルトの入出力
+	Out         *os.File
+	Err         *os.File
+	Name        string          // シェルかスクリプトの名前 ($0)
+	Script      string          // エラーメッセージに出すスクリプトの名前 (標準入力や名前のない-cでは空)
+	Args        []string        // 位置パラメータ ($1, $2, ...)
+	Status      int             // 直前のコマンドの終了ステータス
+	Lineno      int             // 実行中の行番号
+	Timeout     int             // 外部コマンドのタイムアウト秒数 (0なら無制限)
+	Options     map[string]bool // set -oのオプション
+	Disabled    map[string]bool // enable -nで無効にした組み込みコマンド
+	Interactive bool            // 対話モードか
+	LoopDepth   int             // 実行中のループの深さ
+	FuncDepth   int             // 実行中の関数呼び出しの深さ
+	LastBg      int             // 最後にバックグラウンドで実行したプロセスのPID ($!、0ならなし)
+
+	// 3以降のファイル記述子 (exec 3> fileで開いたもの)
+	Fds map[int]*os.File
+
+	// カレントディレクトリとumask
+	// プロセス全体のものは変えずにシェルごとに持ち、外部コマンドの起動とファイルの作成のときに使う
+	// コピーのシェル (パイプの中や( )) で変えても元のシェルには影響しない
+	Dir   string
+	Umask int
+
+	// 外部コマンドを実行する前に呼ばれる (nilなら何もしない)
+	// falseを返すとコマンドを実行せずに終了ステータス1にする
+	PreExec func(cmd []string) (bool, error)
+	// コマンドが終わった後に終了ステータスと一緒に呼ばれる (nilなら何もしない)
+	PostExec func(cmd []string, status int)
+
+	random *rand.Rand // $RANDOMの乱数
+	start  time.Time  // $SECONDSの起点
+
+	// 関数呼び出しごとの、localで隠した変数の元の値
+	locals []map[string]savedVar
+
+	// getoptsが最後に設定した$OPTINDと、その引数の中で次に読む文字の位置
+	optind, optchar int
+	optparams       []string // optcharを数えたときのgetoptsの引数
+
+	inPromptCommand bool // $PROMPT_COMMANDを実行中か
+	evalDepth       int  // 実行中のevalの深さ
+	sourceDepth     int  // 実行中のsourceの深さ
+
+	Traps   map[string]string // trapのコマンド (キーはINTやEXIT)
+	sig     *sigState         // 受け取ったシグナル (コピーのシェルと共有する)
+	noTraps bool              // trapを実行しないか (パイプの中のコマンドなどのコピーのシェル)
+	inTrap  bool              // trapを実行中か
+
+	// SetStdioで切り替える前の入出力 (execはいちばん上を書き換えて、切り替えを戻しても残るようにする)
+	savedStdio []*stdio
+	// execで開いたファイル (どの入出力からも使われなくなったら閉じる)
+	execFiles map[*os.File]bool
+}
+
+// シェルの入出力
+type stdio struct {
+	in, out, err *os.File
+	fds          map[int]*os.File
+}
+
+func NewShell() *Shell {
+	dir, _ := os.Getwd()
+	return &Shell{
+		Dir:      dir,
+		Umask:    processUmask(),
+		Vars:     map[string]string{},
+		Funcs:    map[string]*FuncNode{},
+		Exported: map[string]bool{},
+		Arrays:   map[string][]string{},
+		Assoc:    map[string]map[string]string{},
+		Readonly: map[string]bool{},
+		Integers: map[string]bool{},
+		Options:  map[string]bool{},
+		Disabled: map[string]bool{},
+		Traps:    map[string]string{},
+		sig:      newSigState(),
+		In:       os.Stdin,
+		Out:      os.Stdout,
+		Err:      os.Stderr,
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		start:    time.Now(),
+	}
+}
+
+// 状態をコピーしたシェルを作る (パイプの中のコマンド用)
+// コピーの変数などを変更しても元のシェルには影響しない
+func (sh *Shell) Clone() *Shell {
+	c := *sh
+	c.Vars = maps.Clone(sh.Vars)
+	c.Funcs = maps.Clone(sh.Funcs)
+	c.Exported = maps.Clone(sh.Exported)
+	c.Readonly = maps.Clone(sh.Readonly)
+	c.Integers = maps.Clone(sh.Integers)
+	c.Options = maps.Clone(sh.Options)
+	c.Disabled = maps.Clone(sh.Disabled)
+	c.Args = append([]string{}, sh.Args...)
+	c.Arrays = map[string][]string{}
+	for name, arr := range sh.Arrays {
+		c.Arrays[name] = append([]string{}, arr...)
+	}
+	c.Assoc = map[string]map[string]string{}
+	for name, m := range sh.Assoc {
+		c.Assoc[name] = maps.Clone(m)
+	}
+	c.locals = nil
+	for _, l := range sh.locals {
+		c.locals = append(c.locals, maps.Clone(l))
+	}
+	c.random = rand.New(rand.NewSource(sh.random.Int63()))
+	c.Traps = maps.Clone(sh.Traps)
+	c.noTraps = true
+	c.Fds = maps.Clone(sh.Fds)
+	c.savedStdio = nil
+	c.execFiles = nil
+	return &c
+}
+
+// 相対パスをシェルのカレントディレクトリからのパスにする
+func (sh *Shell) abs(name string) string {
+	return joinDir(sh.Dir, name)
+}
+
+// nameが相対パスならdirの下のパスにする
+// ..やシンボリックリンクの扱いを変えないように、パスは整理せずにつなげる
+func joinDir(dir, name string) string {
+	if name == "" || filepath.IsAbs(name) || dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// エラーのパスをシェルに入力したnameに戻す
+func relPathError(err error, name string) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		pe.Path = name
+	}
+	return err
+}
+
+// umaskの変更はプロセス全体に影響するので、同時に変更しないようにする
+var umaskMu sync.Mutex
+
+// プロセスのumask
+func processUmask() int {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return mask
+}
+
+// プロセスのumaskを一時的にmaskにしてfを実行する
+// 子プロセスは起動したときのumaskを受け継ぐ
+func withUmask(mask int, f func()) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	f()
+}
+
+// シェルの入出力を一時的に切り替える
+// 返り値の関数を呼ぶと元に戻る
+func (sh *Shell) SetStdio(in, out, err *os.File, fds map[int]*os.File) func() {
+	saved := &stdio{sh.In, sh.Out, sh.Err, sh.Fds}
+	sh.savedStdio = append(sh.savedStdio, saved)
+	sh.In, sh.Out, sh.Err, sh.Fds = in, out, err, fds
+	return func() {
+		sh.savedStdio = sh.savedStdio[:len(sh.savedStdio)-1]
+		sh.In, sh.Out, sh.Err, sh.Fds = saved.in, saved.out, saved.err, saved.fds
+	}
+}
+
+// 今の入出力を、直前のSetStdioを戻した後も使うようにする (exec用)
+// caが開いたファイルはシェルが持ち、どの入出力からも使われなくなったら閉じる
+func (sh *Shell) KeepStdio(ca *CmdArg) {
+	cur := &stdio{sh.In, sh.Out, sh.Err, sh.Fds}
+	if n := len(sh.savedStdio); n > 0 {
+		*sh.savedStdio[n-1] = *cur
+	}
+	if sh.execFiles == nil {
+		sh.execFiles = map[*os.File]bool{}
+	}
+	for _, f := range ca.opened {
+		sh.execFiles[f] = true
+	}
+	ca.opened = nil
+
+	used := map[*os.File]bool{}
+	for _, s := range append(sh.savedStdio, cur) {
+		used[s.in], used[s.out], used[s.err] = true, true, true
+		for _, f := range s.fds {
+			used[f] = true
+		}
+	}
+	for f := range sh.execFiles {
+		if !used[f] {
+			f.Close()
+			delete(sh.execFiles, f)
+		}
+	}
+}
+
+// execで開いたファイルをすべて閉じる (コピーのシェルを使い終わったとき用)
+func (sh *Shell) CloseExecFiles() {
+	for f := range sh.execFiles {
+		f.Close()
+	}
+	sh.execFiles = nil
+}
+
+// エラーをシェルのエラー出力に出す
+// 対話モードでなければ行番号を付け、スクリプトならその名前も付ける
+// command not foundは色を付ける
+func (sh *Shell) Error(err error) {
+	msg := err.Error()
+	if errors.Is(err, exec.ErrNotFound) {
+		msg = sh.Color(sh.Err, colorRed, msg)
+	}
+	if !sh.Interactive {
+		if sh.Script == "" {
+			fmt.Fprintf(sh.Err, "toyshell: line %d: %s\n", sh.Lineno, msg)
+		} else {
+			fmt.Fprintf(sh.Err, "toyshell: %s: line %d: %s\n", sh.Script, sh.Lineno, msg)
+		}
+		return
+	}
+	log.New(sh.Err, "", log.LstdFlags).Print(msg)
+}
+
+// ANSIエスケープシーケンスの色
+const (
+	colorRed   = "\x1b[31m"
+	colorBlue  = "\x1b[34m"
+	colorReset = "\x1b[0m"
+)
+
+// set -o colorが有効で、fが端末でNO_COLORが空ならsに色を付ける
+func (sh *Shell) Color(f *os.File, color, s string) string {
+	if !sh.Options["color"] || sh.Get("NO_COLOR") != "" || !isTerminal(f) {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// プロンプトの文字列
+// カレントディレクトリはset -o colorでfが端末なら色を付ける
+func (sh *Shell) Prompt(f *os.File, n int) string {
+	return fmt.Sprintf("%s ./myshell[%d]> ", sh.Color(f, colorBlue, sh.Dir), n)
 }
 
 func main() {
+	sh := NewShell()
+	sh.Name = os.Args[0]
+
+	// オプション
+	// -c stringならstringを実行する。残りの引数は$0, $1, ...になる
+	// -lならログインシェルとして~/.toyshell_profileを読み込む
+	// 対話モードでは~/.toyshellrc (--rcfileで指定したファイル) を読み込む。--norcなら読み込まない
+	// --posixはset -o posixと同じ
+	args := os.Args[1:]
+	command, hasCommand := "", false
+	login, norc := false, false
+	rcfile := ""
+options:
+	for len(args) > 0 {
+		switch args[0] {
+		case "-n":
+			sh.Options["noexec"] = true
+		case "-l", "--login":
+			login = true
+		case "--norc":
+			norc = true
+		case "--posix":
+			sh.Options["posix"] = true
+		case "-c", "--rcfile":
+			if len(args) < 2 {
+				fmt.Fprintf(os.Stderr, "toyshell: %s: option requires an argument\n", args[0])
+				os.Exit(2)
+			}
+			if args[0] == "-c" {
+				command, hasCommand = args[1], true
+			} else {
+				rcfile = args[1]
+			}
+			args = args[1:]
+		default:
+			break options
+		}
+		args = args[1:]
+	}
+
+	// 引数があればスクリプトとして実行
+	// 標準入力が端末でなければ (パイプなど) プロンプトを出さない
+	// 端末でない標準入力からスクリプトを読むときは、readや外部コマンドの入力を先に読まないように1バイトずつ読む
+	sh.Interactive = isTerminal(os.Stdin)
+	var in io.Reader = os.Stdin
+	if !sh.Interactive {
+		in = byteReader{os.Stdin}
+	}
+	if hasCommand {
+		in = strings.NewReader(command)
+		sh.Interactive = false
+		if len(args) > 0 {
+			sh.Name, sh.Script = args[0], args[0]
+			sh.Args = args[1:]
+		}
+	} else if len(args) > 0 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+		sh.Interactive = false
+		sh.Name, sh.Script = args[0], args[0]
+		sh.Args = args[1:]
+	}
+
+	// シグナル初期化
+	// SIGINTではシェルを終了せず、実行中の外部コマンドに転送する
+	sh.HandleInterrupt()
+
+	// exitが実行されたら、その終了ステータスにしてtrueを返す
+	exited := func(err error) bool {
+		ec, ok := err.(*ExitControl)
+		if ok {
+			sh.Status = ec.Status
+		}
+		return ok
+	}
+
+	// 起動ファイル
+	// 指定しなかったファイルがなくてもエラーにしない
+	startup := CmdArg{Sh: sh}
+	home, _ := os.UserHomeDir()
+	var err error
+	if login {
+		err = startup.SourceStartup(filepath.Join(home, ".toyshell_profile"), false)
+	} else if sh.Interactive && !norc {
+		if rcfile != "" {
+			err = startup.SourceStartup(rcfile, true)
+		} else {
+			err = startup.SourceStartup(filepath.Join(home, ".toyshellrc"), false)
+		}
+	}
+	if exited(err) {
+		sh.Exit(true)
+		return
+	}
+
+	scanner := NewInputScanner(in)
 	loopCnt := 0
+	line := 0 // 読み込んだ行数
+	exit := false
 	for {
 		var ca CmdArg
+		ca.Sh = sh
 
-		// シグナル初期化
-		ca.SigCh = make(chan os.Signal, 1)
-		signal.Notify(ca.SigCh, syscall.SIGINT)
+		if exited(ca.RunTraps()) {
+			exit = true
+			break
+		}
 
 		// プロンプト表示
-		fmt.Printf("./myshell[%d]> ", loopCnt)
+		if sh.Interactive {
+			if exited(ca.PromptCommand()) {
+				exit = true
+				break
+			}
+			fmt.Print(sh.Prompt(os.Stdout, loopCnt))
+		}
 
 		// 入力を3項間演算子でパース
-		cmd, err := ParseInput()
-		if err != io.EOF && err != nil {
-			log.Print(err)
+		text, err := ReadLine(scanner)
+		line++
+
+		// 入力を待っている間に受け取ったシグナルのtrap
+		// SIGINTはこれから実行するforループを止めない
+		if exited(ca.RunTraps()) {
+			exit = true
+			break
+		}
+		sh.sig.takeInterrupt()
+
+		// シェル終了 (読み込めなければエラーを出して終了)
+		if err != nil {
+			if err != io.EOF {
+				sh.Lineno = line
+				sh.Error(err)
+				sh.Status = 1
+			}
+			break
 		}
 
+		var input inputLines
+		input.add(text)
+
 		// 何も入力されなければcontinue
-		if len(cmd) == 0 {
+		if len(input.toks) == 0 {
 			loopCnt++
 			continue
 		}
 
-		// シェル終了
-		if err == io.EOF {
+		if len(input.toks) == 1 && input.toks[0].Is(WordToken, "bye") {
 			break
 		}
-		if len(cmd) == 1 && cmd[0] == "bye" {
-			break
+
+		// for文などが閉じていなければ続きの行を読む
+		start := line
+		nodes, err := ParseList(input.toks, start)
+		for err == ErrIncomplete {
+			if sh.Interactive {
+				fmt.Print("> ")
+			}
+			more, rerr := ReadLine(scanner)
+			if rerr != nil {
+				break
+			}
+			line++
+			input.add(more)
+			nodes, err = ParseList(input.toks, start)
+		}
+		sh.Lineno = line
+		if se, ok := err.(*SyntaxError); ok {
+			sh.Lineno = se.Line
+		}
+		if err != nil {
+			sh.Error(err)
+			// 構文エラーは行とトークンの位置を表示する
+			if se, ok := err.(*SyntaxError); ok && se.Tok >= 0 && se.Tok < len(input.toks) {
+				fmt.Fprint(sh.Err, input.caret(se.Tok))
+			}
+			sh.Status = 2
+			loopCnt++
+			continue
 		}
 
-		// シェル実行
-		ca.Shell(cmd)
+		// シェル実行 (set -nの後はExecが何も実行しない)
+		if exited(ca.ExecRecover(nodes)) {
+			exit = true
+			break
+		}
 
 		loopCnt++
 	}
+
+	sh.Exit(exit)
 }
 
-// cmd?yes:noを処理
-// cmd ? b ? yb : nb : c ? yc : ncのようなネストされた3項間にも対応
-func (ca *CmdArg) Shell(cmd []string) (*os.ProcessState, error) {
-	// 入力を3項間演算子でparse
-	cmd, yes, no := ParseTernaryOperator(cmd)
+// EXITのtrapを実行してシェルを終了する
+// スクリプトとexitでは直前の終了ステータスで終了する。対話モードの入力の終わりではmainから戻る
+func (sh *Shell) Exit(exit bool) {
+	ca := CmdArg{Sh: sh}
+	ca.RunTrap(trapExit)
+	if !sh.Interactive || exit {
+		os.Exit(sh.Status)
+	}
+}
 
-	// シェル実行
-	status, err := ca.ShellMain(cmd)
-	if err != nil {
-		log.Print(err)
+// 入力された1行分のコマンドを実行する
+// シェルのバグでpanicしても終了せず、エラーを出してプロンプトに戻る
+// exitを実行したらExitControlを返す
+func (ca *CmdArg) ExecRecover(nodes []Node) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ca.Sh.Error(internalError(r))
+			ca.Sh.Status = 1
+			err = nil
+		}
+	}()
+	_, err = ca.Exec(nodes)
+	return err
+}
+
+// シェルのバグでpanicしたときのエラー
+func internalError(r interface{}) error {
+	return fmt.Errorf("internal error: %v", r)
+}
+
+// runを実行する。panicしたらシェルを終了させず、終了ステータス1の内部エラーを返す
+func runRecover(run func() (int, error)) (status int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			status, err = 1, internalError(r)
+		}
+	}()
+	return run()
+}
+
+// ゴルーチンの中でpanicしたら、シェルを終了させずに内部エラーをエラー出力に出す
+// ゴルーチンの最初にdeferで呼ぶ
+func (sh *Shell) recoverGo() {
+	if r := recover(); r != nil {
+		sh.Error(internalError(r))
 	}
+}
 
-	// SIGINT 割り込み
-	go func() {
-		select {
-		case <-ca.SigCh:
-			fmt.Println("(SIGINT caught!)")
-			fmt.Printf("process %d exited with status(%d)\n", status.Pid(), status.ExitCode())
+// プロンプトを出す前に$PROMPT_COMMANDを実行する
+func (ca *CmdArg) PromptCommand() error {
+	src := ca.Sh.Get("PROMPT_COMMAND")
+	if src == "" || ca.Sh.inPromptCommand {
+		return nil
+	}
+	ca.Sh.inPromptCommand = true
+	defer func() { ca.Sh.inPromptCommand = false }()
+	return ca.EvalHook(src)
+}
+
+// $PROMPT_COMMANDやtrapのコマンドを実行する
+// 終了ステータス ($?と$PIPESTATUS) と行番号は変えない
+// exitを実行したときだけExitControlを返す
+func (ca *CmdArg) EvalHook(src string) error {
+	status, lineno := ca.Sh.Status, ca.Sh.Lineno
+	pipeStatus, ok := ca.Sh.Arrays["PIPESTATUS"]
+	defer func() {
+		ca.Sh.Status, ca.Sh.Lineno = status, lineno
+		if ok {
+			ca.Sh.SetArray("PIPESTATUS", pipeStatus)
+		} else {
+			delete(ca.Sh.Arrays, "PIPESTATUS")
 		}
 	}()
+	_, err := ca.Eval(src)
+	if _, ok := err.(*ExitControl); ok {
+		return err
+	}
+	return nil
+}
+
+// 3項間演算子とパイプで分けたコマンド
+// Stages ? Yes : No (3項間演算子がなければYesとNoはnil)
+type CmdTree struct {
+	Stages  [][]Token // A|B|CをA, B, Cに分けたもの
+	Yes, No *CmdTree
+}
+
+// argsを3項間演算子とパイプで分ける
+// 構文解析のときに1回だけ呼び、実行するたびに分け直さない
+func ParseCmdTree(args []Token) *CmdTree {
+	cmd, yes, no := ParseTernaryOperator(args)
+	t := &CmdTree{Stages: SplitPipe(cmd)}
+	if yes != nil && no != nil {
+		t.Yes, t.No = ParseCmdTree(yes), ParseCmdTree(no)
+	}
+	return t
+}
+
+// cmd?yes:noを処理
+// cmd ? b ? yb : nb : c ? yc : ncのようなネストされた3項間にも対応
+// エラーは出力し、break等の制御用のエラーだけを返す
+func (ca *CmdArg) ShellTree(t *CmdTree) (int, error) {
+	// シェル実行
+	status, err := ca.ShellMain(t.Stages)
+	if IsControl(err) {
+		return status, err
+	}
+	if err != nil {
+		ca.Sh.Error(err)
+	}
 
 	// 最初のコマンドの実行結果に応じて2番目3番目のコマンドを実行
-	isTernOp := bool(yes != nil && no != nil)
-	if isTernOp {
-		if status.Success() {
-			yca := CmdArg{}
-			_, err := yca.Shell(yes)
-			if err != nil {
-				log.Print(err)
-			}
+	if t.Yes != nil && t.No != nil {
+		if status == 0 {
+			yca := CmdArg{Sh: ca.Sh}
+			return yca.ShellTree(t.Yes)
 		} else {
-			nca := CmdArg{}
-			_, err := nca.Shell(no)
-			if err != nil {
-				log.Print(err)
-			}
+			nca := CmdArg{Sh: ca.Sh}
+			return nca.ShellTree(t.No)
 		}
 	}
 
-	return nil, nil
+	return status, nil
 }
 
 // 3項間で分けられたコマンド、パイプ、リダイレクトの処理
-func (ca *CmdArg) ShellMain(args []string) (*os.ProcessState, error) {
-	// A|B|C|DをA|B|CとDに分ける
-	args1, args2 := ParsePipe(args)
+func (ca *CmdArg) ShellMain(stages [][]Token) (int, error) {
+	if len(stages) > 1 {
+		return ca.RunPipeline(stages)
+	}
+
+	status, err := ca.runSimple(stages[0])
+	ca.Sh.SetPipeStatus([]int{status})
+	return status, err
+}
+
+// パイプを含まないコマンドを実行
+func (ca *CmdArg) runSimple(args []Token) (int, error) {
+	// [[ ]]は展開する前の単語のまま評価する
+	// set -o posixなら[[はただのコマンド名
+	// PostExecには展開する前の単語を渡す
+	if len(args) > 0 && args[0].Is(WordToken, "[[") && !ca.Sh.Options["posix"] {
+		cmd := Words(args)
+		status, err := ca.Sh.Cond(cmd)
+		if ca.Sh.PostExec != nil {
+			ca.Sh.PostExec(cmd, status)
+		}
+		return status, err
+	}
 
 	// redirectをパース
-	err := ca.ParseRedirect(args2)
+	err := ca.ParseRedirect(args)
+	defer ca.CloseFiles()
 	if err != nil {
-		return nil, err
+		return 1, err
+	}
+
+	return ca.Run()
+}
+
+// コマンドを実行してPostExecを呼ぶ
+func (ca *CmdArg) Run() (int, error) {
+	cmd := ca.Cmd
+	status, err := ca.Dispatch(false)
+	if ca.Sh.PostExec != nil && len(cmd) > 0 {
+		ca.Sh.PostExec(cmd, status)
+	}
+	return status, err
+}
+
+// ca.Cmdを組み込みコマンド、関数、外部コマンドの順に探して実行
+// skipFuncsなら関数を探さない (commandで使う)
+func (ca *CmdArg) Dispatch(skipFuncs bool) (int, error) {
+	if len(ca.Cmd) == 0 {
+		return 0, nil
+	}
+
+	// 実行中はシェルの入出力をリダイレクト先に向ける
+	if f, ok := ca.Sh.Builtin(ca.Cmd[0]); ok {
+		restore := ca.Sh.SetStdio(ca.In, ca.Out, ca.Err, ca.Fds)
+		defer restore()
+		status, err := f(ca, ca.Cmd)
+		// 読み手がいなくなったパイプへの書き込みはSIGPIPEで終了したことにする
+		if errors.Is(err, syscall.EPIPE) {
+			return 128 + int(syscall.SIGPIPE), nil
+		}
+		if err != nil && !IsControl(err) {
+			ca.Sh.Error(closedFileError(ca.Cmd[0], err))
+			err = nil
+		}
+		return status, err
+	}
+	if fn, ok := ca.Sh.Funcs[ca.Cmd[0]]; ok && !skipFuncs {
+		restore := ca.Sh.SetStdio(ca.In, ca.Out, ca.Err, ca.Fds)
+		defer restore()
+		return ca.CallFunc(fn, ca.Cmd[1:])
 	}
+	return ca.RunExternal()
+}
 
-	// パイプがある場合の処理
-	if len(args1) > 0 {
-		// A|B|Cの処理結果を返す
-		in, err := ca.ProcessPipe(args1)
-		defer in.Close()
+// PreExecを呼んでから外部コマンドを実行する
+func (ca *CmdArg) RunExternal() (int, error) {
+	if ca.Sh.PreExec != nil {
+		ok, err := ca.Sh.PreExec(ca.Cmd)
 		if err != nil {
-			return nil, err
+			return 1, err
+		}
+		if !ok {
+			return 1, nil
 		}
-		ca.Attr.Files[0] = in.Fd()
 	}
+	return ExitStatus(RunCmd(ca))
+}
 
-	return RunCmd(*ca)
+// パイプでつながったコマンドを同時に実行する
+// 組み込みコマンドや関数はシェルのコピーの中で実行するので、変数の変更などは残らない
+// 終了ステータスは最後のコマンドのもの (pipefailなら最後に失敗したコマンドのもの)
+func (ca *CmdArg) RunPipeline(stages [][]Token) (int, error) {
+	return ca.runStages(len(stages), func(i int, sca *CmdArg) (int, error) {
+		if err := sca.ParseRedirect(stages[i]); err != nil {
+			return 1, err
+		}
+		return sca.Run()
+	})
 }
 
-// パイプを再帰的に処理する
-func (ca *CmdArg) ProcessPipe(args []string) (*os.File, error) {
-	// A|B|CをA|BとCに分ける
-	args1, args2 := ParsePipe(args)
+// n個のコマンドをパイプでつないで同時に実行する
+// runはi番目のコマンドを、パイプを入出力にしたシェルのコピーsca.Shで実行する
+func (ca *CmdArg) runStages(n int, run func(i int, sca *CmdArg) (int, error)) (int, error) {
+	cas := make([]CmdArg, n)
+	statuses := make([]int, n)
 
-	// parse redirect
-	err := ca.ParseRedirect(args2)
-	if err != nil {
-		return nil, err
+	// i番目のコマンドの出力をi+1番目のコマンドの入力につなぐ
+	ins := make([]*os.File, n)
+	outs := make([]*os.File, n)
+	for i := 0; i < n-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			for _, f := range append(ins, outs...) {
+				if f != nil {
+					f.Close()
+				}
+			}
+			return 1, err
+		}
+		outs[i], ins[i+1] = w, r
 	}
 
-	// make a pipe
-	pin, pout, err := os.Pipe()
-	defer pout.Close()
-	ca.Attr.Files[1] = pout.Fd()
+	var wg sync.WaitGroup
+	for i := range cas {
+		sca := &cas[i]
+		*sca = CmdArg{Sh: ca.Sh.Clone()}
 
-	// まだパイプが残ってるとき
-	if len(args1) > 0 {
-		// 再帰的にパイプを処理
-		in, err := ca.ProcessPipe(args1)
-		defer in.Close()
-		if err != nil {
-			return nil, err
+		// パイプをデフォルトの入出力にする
+		if ins[i] != nil {
+			sca.Sh.In = ins[i]
+		}
+		if outs[i] != nil {
+			sca.Sh.Out = outs[i]
 		}
-		ca.Attr.Files[0] = in.Fd()
-	}
 
-	// run command
-	_, err = RunCmd(*ca)
-	if err != nil {
-		return nil, err
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			statuses[i], err = runRecover(func() (int, error) { return run(i, sca) })
+			// エラーはそのコマンドのエラー出力に出す
+			if err != nil && !IsControl(err) {
+				if sca.Err != nil {
+					sca.Sh.Err = sca.Err
+				}
+				sca.Sh.Error(err)
+			}
+
+			// 親プロセスの持つパイプを閉じて、前後のコマンドにEOFやSIGPIPEを伝える
+			sca.CloseFiles()
+			sca.Sh.CloseExecFiles()
+			for _, f := range []*os.File{ins[i], outs[i]} {
+				if f != nil {
+					f.Close()
+				}
+			}
+		}(i)
 	}
+	wg.Wait()
+	ca.Sh.SetPipeStatus(statuses)
 
-	// 出力先を返す
-	return pin, nil
+	status := statuses[n-1]
+	if ca.Sh.Options["pipefail"] {
+		status = 0
+		for _, st := range statuses {
+			if st != 0 {
+				status = st
+			}
+		}
+	}
+	return status, nil
 }
 
 // 引数のコマンドを実行
-func RunCmd(ca CmdArg) (*os.ProcessState, error) {
+// caはパイプの各コマンドなどで別々のものを渡す (Attr.Filesを共有しない)
+func RunCmd(ca *CmdArg) (*os.ProcessState, error) {
+	// 展開の結果コマンドが空になった
+	if len(ca.Cmd) == 0 {
+		return nil, nil
+	}
+
 	// 入力したコマンドが存在するか確認
-	cpath, err := exec.LookPath(ca.Cmd[0])
+	cpath, err := LookPathIn(ca.Cmd[0], ca.Sh.Get("PATH"), ca.Sh.Dir)
 	if err != nil {
 		return nil, err
 	}
 
+	// コマンドを実行する前に受け取ったシグナルはtrapを実行し、SIGINTは転送しない
+	if err := ca.RunTraps(); err != nil {
+		return nil, err
+	}
+	ca.Sh.sig.takeInterrupt()
+
+	// タイムアウトしたときに孫プロセスもまとめて終わらせられるよう、子プロセスを別のプロセスグループにする
+	// 対話モードでは端末から読むコマンドが止まらないよう、シェルと同じグループのままにする
+	group := ca.Sh.Timeout > 0 && !ca.Sh.Interactive
+	if group {
+		ca.Attr.Sys = &syscall.SysProcAttr{Setpgid: true}
+	}
+
 	// コマンド実行
-	pid, err := syscall.ForkExec(cpath, ca.Cmd, &ca.Attr)
+	// カレントディレクトリはAttr.Dir、umaskは起動するときだけシェルのものにする
+	var pid int
+	withUmask(ca.Sh.Umask, func() {
+		pid, err = syscall.ForkExec(cpath, ca.Cmd, &ca.Attr)
+	})
 	if err != nil {
 		return nil, err
 	}
+	if debugMode {
+		debugf("fork pid %d: %s %q", pid, cpath, ca.Cmd[1:])
+	}
 
 	// 実行したプロセスの状態を取得
 	proc, _ := os.FindProcess(pid)
 
-	go func() {
-		select {
-		case s := <-ca.SigCh:
-			proc.Signal(s)
-			ca.SigCh <- s
-		}
-	}()
+	// 実行している間に受け取ったSIGINTを子プロセスに転送
+	ca.Sh.sig.startChild(proc)
+
+	// タイムアウトの監視
+	// doneはプロセスが終わったら閉じる
+	done := make(chan struct{})
+	expired := ca.Sh.WatchTimeout(proc, group, done)
 
 	// 実行が終わるまで待つ
 	status, err := proc.Wait()
+	close(done)
+	caught := ca.Sh.sig.endChild(proc)
 	if err != nil {
 		return nil, err
 	}
+	if debugMode {
+		debugf("pid %d: %s", pid, status)
+	}
+
+	// タイムアウトで終了させた
+	select {
+	case <-expired:
+		return status, fmt.Errorf("%s: %w after %d seconds", ca.Cmd[0], ErrTimeout, ca.Sh.Timeout)
+	default:
+	}
+
+	// SIGINT 割り込み
+	if caught {
+		fmt.Fprintln(ca.Sh.Err, "(SIGINT caught!)")
+		fmt.Fprintf(ca.Sh.Err, "process %d exited with status(%d)\n", status.Pid(), status.ExitCode())
+	}
 
-	// 成功しなければメッセージを出力
-	if !status.Success() {
-		fmt.Println(status.String())
+	// シグナルで終了したらシグナルの説明をエラー出力に出す (パイプが閉じられたときは出さない)
+	// 0以外の終了ステータスで終わっただけなら何も出さない
+	if ws, ok := status.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() != syscall.SIGPIPE {
+		fmt.Fprintln(ca.Sh.Err, SignalMessage(ws))
 	}
 
 	return status, nil
 }
 
+// set timeoutの時間を過ぎたコマンドのエラー
+var ErrTimeout = errors.New("timed out")
+
+// タイムアウトしてからSIGKILLを送るまでの猶予
+const killGrace = 5 * time.Second
+
+// set timeoutの秒数経ってもdoneが閉じられなければprocにSIGTERMを送る
+// それでも終わらなければSIGKILLを送る
+// groupならprocのプロセスグループ全体に送る
+// timeoutが0ならなにもしない。タイムアウトしたら返り値のチャネルに通知する
+func (sh *Shell) WatchTimeout(proc *os.Process, group bool, done <-chan struct{}) <-chan struct{} {
+	expired := make(chan struct{}, 1)
+	timeout := sh.Timeout
+	if timeout <= 0 {
+		return expired
+	}
+	kill := func(sig syscall.Signal) {
+		if group {
+			syscall.Kill(-proc.Pid, sig)
+			return
+		}
+		proc.Signal(sig)
+	}
+
+	go func() {
+		defer sh.recoverGo()
+		select {
+		case <-time.After(time.Duration(timeout) * time.Second):
+		case <-done:
+			return
+		}
+		expired <- struct{}{}
+		kill(syscall.SIGTERM)
+
+		select {
+		case <-time.After(killGrace):
+			kill(syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	return expired
+}
+
+// RunCmdの結果を終了ステータスに変換
+func ExitStatus(status *os.ProcessState, err error) (int, error) {
+	if ec, ok := err.(*ExitControl); ok {
+		return ec.Status, err
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return 127, err
+	}
+	if errors.Is(err, ErrTimeout) {
+		return 124, err
+	}
+	if err != nil {
+		return 1, err
+	}
+	// 何も実行しなかった
+	if status == nil {
+		return 0, nil
+	}
+	// シグナルで終了したら128+シグナル番号
+	if ws, ok := status.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), nil
+	}
+	return status.ExitCode(), nil
+}
+
+// シグナルで終了したときのメッセージ
+// 例: Segmentation fault (core dumped)
+func SignalMessage(ws syscall.WaitStatus) string {
+	msg := ws.Signal().String()
+	if msg != "" {
+		msg = strings.ToUpper(msg[:1]) + msg[1:]
+	}
+	if ws.CoreDump() {
+		msg += " (core dumped)"
+	}
+	return msg
+}
+
 /*
 	入力等のパース処理
 */
-// プロンプトに入力された文字列をパース
-func ParseInput() ([]string, error) {
-	// 標準入力
-	scanner := bufio.NewScanner(os.Stdin)
+// 1行の長さの上限
+// bufio.Scannerのデフォルト (64KB) より長い行も読めるようにする
+const maxInputLine = 1 << 30
+
+// 入力を1行ずつ読むScannerを作る
+func NewInputScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxInputLine)
+	return scanner
+}
+
+// 1回のReadで1バイトだけ読むReader
+// bufio.Scannerが改行より先を読まないようにする
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
 
+// 1行読む
+// 入力の終わりならio.EOF
+func ReadLine(scanner *bufio.Scanner) (string, error) {
 	// EOFチェック
 	if !scanner.Scan() {
-		return nil, io.EOF
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return scanner.Text(), nil
+}
+
+// トークンの種類
+type TokenKind int
+
+const (
+	WordToken     TokenKind = iota // コマンド名や引数 (クォートした"|"なども含む)
+	OperatorToken                  // ; | ( )と3項間演算子の? :
+	RedirectToken                  // < > >| 2>
+	NewlineToken                   // 複数行の入力の行の区切り
+)
+
+// 入力の行の中のトークン
+type Token struct {
+	Text       string
+	Kind       TokenKind
+	Start, End int // 行の中のバイト位置
+}
+
+// kindのトークンで、文字列がtextか
+func (t Token) Is(kind TokenKind, text string) bool {
+	return t.Kind == kind && t.Text == text
+}
+
+// 入力の分離記号
+// 同じ位置では前にあるものを優先する (>|や2>を>より先に分ける)
+// 3項間演算子の?と:は分離記号ではない (a:bや?.goは1つの単語になる)
+// N>は2>や3<、10>のような数字の付いたリダイレクトを表す
+var inputSeparators = []string{" ", "\t", ";", "<", "N>", ">|", ">", "|", "(", ")"}
+
+// 数字の付いたリダイレクトは単語の先頭か、これより前の分離記号の後にあるときだけ分ける (a2>fileはa2と>とfile)
+const redirectFdSep = 4
+
+// 行を分離記号で分けて、空白以外のトークンを返す
+// 行を1回だけ走査する。クォートと${...}の中、\の次の文字では分けない
+// 単語の先頭の#から行末まではコメントとして捨てる
+func Tokenize(line string) []Token {
+	toks := make([]Token, 0, strings.Count(line, " ")+1)
+	var quote byte
+	depth := 0
+	start := 0 // 今の単語の開始位置
+	seg := 0   // N>より前の分離記号で区切った部分の開始位置
+
+	// 空白だけの単語は捨てる
+	word := func(end int) {
+		if strings.TrimSpace(line[start:end]) != "" {
+			toks = append(toks, Token{Text: line[start:end], Kind: WordToken, Start: start, End: end})
+		}
+	}
+
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote == 0 && depth == 0 {
+			if c == '#' && i == start {
+				end = i
+				break
+			}
+			if k, sep := matchSeparator(line, i, seg); k >= 0 {
+				word(i)
+				if sep != " " && sep != "\t" {
+					kind := OperatorToken
+					if isRedirect(sep) {
+						kind = RedirectToken
+					}
+					toks = append(toks, Token{Text: sep, Kind: kind, Start: i, End: i + len(sep)})
+				}
+				i += len(sep) - 1
+				start = i + 1
+				if k < redirectFdSep {
+					seg = start
+				}
+				continue
+			}
+		}
+
+		switch {
+		case c == '\\' && quote != '\'':
+			i++
+		case quote != '\'' && strings.HasPrefix(line[i:], "${"):
+			depth++
+			i++
+		case quote != '\'' && c == '}' && depth > 0:
+			depth--
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == c:
+			quote = 0
+		}
+	}
+	if start < end {
+		word(end)
+	}
+	markTernary(toks)
+	return toks
+}
+
+// 単独の?を3項間演算子にする。:は同じ( )の中で?が残っているときだけ演算子にする
+// ;で区切ったコマンドごとに数え直す。[[ ]]の中の?と:はパターンの文字なので単語のまま
+func markTernary(toks []Token) {
+	pending := []int{0} // ( )の深さごとの、:がまだ来ていない?の数
+	cond := false
+	for i, t := range toks {
+		top := len(pending) - 1
+		switch {
+		case t.Is(WordToken, "[[") && !cond:
+			cond = true
+		case t.Is(WordToken, "]]") && cond:
+			cond = false
+		case cond:
+		case t.Is(OperatorToken, "("):
+			pending = append(pending, 0)
+		case t.Is(OperatorToken, ")") && top > 0:
+			pending = pending[:top]
+		case t.Is(OperatorToken, ";"):
+			pending[top] = 0
+		case t.Is(WordToken, "?"):
+			toks[i].Kind = OperatorToken
+			pending[top]++
+		case t.Is(WordToken, ":") && pending[top] > 0:
+			toks[i].Kind = OperatorToken
+			pending[top]--
+		}
+	}
+}
+
+// line[i:]の先頭にある分離記号のinputSeparatorsでの添字と、その文字列 (なければ-1)
+// segは数字の付いたリダイレクトを分けてよいか決める部分の開始位置
+func matchSeparator(line string, i, seg int) (int, string) {
+	for k, sep := range inputSeparators {
+		if k == redirectFdSep {
+			j := i
+			for i == seg && j < len(line) && '0' <= line[j] && line[j] <= '9' {
+				j++
+			}
+			if j > i && j < len(line) && (line[j] == '>' || line[j] == '<') {
+				return k, line[i : j+1]
+			}
+			continue
+		}
+		if strings.HasPrefix(line[i:], sep) {
+			return k, sep
+		}
+	}
+	return -1, ""
+}
+
+// トークンの文字列だけを返す
+func Words(toks []Token) []string {
+	words := make([]string, len(toks))
+	for i, t := range toks {
+		words[i] = t.Text
 	}
-	line := scanner.Text()
+	return words
+}
 
-	// 入力を分離記号で分離
-	sep := []string{" ", "?", ":", "<", ">", "2>", "|"}
-	args := SplitMultiSep(line, sep)
-	args = SkipWhiteSpace(args)
+// for文などで複数行になった入力
+// 構文エラーの位置を表示するために、各トークンがどの行にあったかを覚えておく
+type inputLines struct {
+	lines []string
+	toks  []Token
+	rows  []int // toks[i]があるlinesの行
+}
 
-	return args, nil
+// 1行追加する
+// 2行目からは前に改行のトークン ("\n") を入れる
+func (in *inputLines) add(line string) {
+	if len(in.lines) > 0 {
+		prev := len(in.lines) - 1
+		in.toks = append(in.toks, Token{Text: "\n", Kind: NewlineToken, Start: len(in.lines[prev]), End: len(in.lines[prev])})
+		in.rows = append(in.rows, prev)
+	}
+	for _, t := range Tokenize(line) {
+		in.toks = append(in.toks, t)
+		in.rows = append(in.rows, len(in.lines))
+	}
+	in.lines = append(in.lines, line)
+}
+
+// i番目のトークンがある行と、その下にトークンの位置を示す^を付けた行
+func (in *inputLines) caret(i int) string {
+	line := in.lines[in.rows[i]]
+	var sb strings.Builder
+	// タブはそのまま使って位置を揃える
+	for _, c := range line[:in.toks[i].Start] {
+		if c == '\t' {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return line + "\n" + sb.String() + "^\n"
 }
 
 // argsを?と:で分ける
 // (A ? (B ? y : n) : (C ? y : n))にも対応したい
-func ParseTernaryOperator(args []string) ([]string, []string, []string) {
+// ?と:はTokenizeが演算子にしたものだけを数える ([[ ]]の中や単語の一部の?と:は数えない)
+func ParseTernaryOperator(args []Token) ([]Token, []Token, []Token) {
 	// yesとnoの開始位置
 	n := len(args)
 	yi := n
@@ -234,10 +1200,10 @@ func ParseTernaryOperator(args []string) ([]string, []string, []string) {
 	cnt := 0
 	// yiとniを決定
 	for i, a := range args {
-		if a == "?" {
+		if a.Is(OperatorToken, "?") {
 			cnt += 1
 		}
-		if a == ":" {
+		if a.Is(OperatorToken, ":") {
 			cnt -= 1
 		}
 		if yi == n && cnt == 1 {
@@ -249,14 +1215,14 @@ func ParseTernaryOperator(args []string) ([]string, []string, []string) {
 		}
 	}
 
-	var cmd, yes, no []string
+	var cmd, yes, no []Token
 	// cmd
-	cmd = make([]string, yi)
+	cmd = make([]Token, yi)
 	copy(cmd, args[:yi])
 
 	if yi != n && ni != n {
 		// yes
-		yes = make([]string, ni-yi-1)
+		yes = make([]Token, ni-yi-1)
 		copy(yes, args[yi+1:ni])
 
 		// no
@@ -267,117 +1233,401 @@ func ParseTernaryOperator(args []string) ([]string, []string, []string) {
 }
 
 // リダイレクトをパース
-func (ca *CmdArg) ParseRedirect(cmd []string) error {
+func (ca *CmdArg) ParseRedirect(cmd []Token) error {
 	// 変数初期化
-	in := os.Stdin
-	out := os.Stdout
-	err := os.Stderr
+	// fdsはファイル記述子ごとのリダイレクト先 (3以降はexecで開いたものとプロセス置換)
+	fds := map[int]*os.File{0: ca.Sh.In, 1: ca.Sh.Out, 2: ca.Sh.Err}
+	for n, f := range ca.Sh.Fds {
+		fds[n] = f
+	}
 	var newCmd []string
-	var perr error
 
-	i := 0
-	// commandを取得
-	for i = 0; i < len(cmd); i++ {
-		// リダイレクト記号が来たらbreak
-		if cmd[i] == "<" || cmd[i] == ">" || cmd[i] == "2>" {
-			break
-		}
-		// white-space以外ならnewCmdに追加
-		if cmd[i] != "" && cmd[i] != " " && cmd[i] != "\t" && cmd[i] != "\n" {
-			newCmd = append(newCmd, cmd[i])
-		}
+	// <(か>(ならプロセス置換
+	// set -o posixならプロセス置換は使えない
+	procSubst := !ca.Sh.Options["posix"]
+	isProcSubst := func(i int) bool {
+		return procSubst && i+1 < len(cmd) && (cmd[i].Is(RedirectToken, "<") || cmd[i].Is(RedirectToken, ">")) && cmd[i+1].Is(OperatorToken, "(")
 	}
 
-	// リダイレクト先を取得
-	for ; i < len(cmd); i++ {
-		if cmd[i] == "<" {
-			in, perr = os.OpenFile(cmd[i+1], os.O_RDONLY, 0666)
+	// リダイレクトはコマンドの前や途中にも書ける (> out echo hi)
+	// リダイレクト記号とその次の単語以外がコマンドになる
+	for i := 0; i < len(cmd); i++ {
+		// <(cmd)と>(cmd)はパイプの/dev/fd/Nに置き換える
+		// Nは3以降で空いている最初のファイル記述子
+		if isProcSubst(i) {
+			end := closeParen(cmd, i+1)
+			if end == -1 {
+				return fmt.Errorf("syntax error: missing `)'")
+			}
+			f, perr := ca.ProcSubst(cmd[i+2:end], cmd[i].Text == "<")
 			if perr != nil {
 				return perr
 			}
+			n := 3
+			for fds[n] != nil {
+				n++
+			}
+			fds[n] = f
+			newCmd = append(newCmd, fmt.Sprintf("/dev/fd/%d", n))
+			i = end
+			continue
+		}
+
+		// リダイレクト以外なら展開してnewCmdに追加
+		if cmd[i].Kind != RedirectToken {
+			if cmd[i].Kind != NewlineToken {
+				words, perr := ca.Sh.Expand(cmd[i].Text)
+				if perr != nil {
+					return perr
+				}
+				newCmd = append(newCmd, words...)
+			}
+			continue
+		}
+
+		// リダイレクト先を取得
+		if i+1 >= len(cmd) {
+			return fmt.Errorf("syntax error near unexpected token `newline'")
 		}
-		if cmd[i] == ">" {
-			out, perr = os.OpenFile(cmd[i+1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		op, target := cmd[i].Text, cmd[i+1]
+		fd, input := redirectFd(op)
+		if fd < 0 {
+			return fmt.Errorf("%s: bad file descriptor", op[:len(op)-1])
+		}
+		// > >(cmd)のようにプロセス置換にリダイレクトする
+		if isProcSubst(i + 1) {
+			end := closeParen(cmd, i+2)
+			if end == -1 {
+				return fmt.Errorf("syntax error: missing `)'")
+			}
+			f, perr := ca.ProcSubst(cmd[i+3:end], target.Text == "<")
 			if perr != nil {
 				return perr
 			}
+			fds[fd] = f
+			i = end
+			continue
 		}
-		if cmd[i] == "2>" {
-			err, perr = os.OpenFile(cmd[i+1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if target.Kind != WordToken {
+			return fmt.Errorf("syntax error near unexpected token `%s'", target.Text)
+		}
+		// >&-、2>&-、<&-、3>&-はそのファイル記述子を閉じる
+		if target.Text == "&-" {
+			if fd > 2 {
+				delete(fds, fd)
+				i++
+				continue
+			}
+			f, perr := closedFile()
 			if perr != nil {
 				return perr
 			}
+			fds[fd] = f
+			i++
+			continue
+		}
+		// >&2や2>&1、<&3は、その時点でのもう一方のファイル記述子を複製する
+		// 左から順に処理するので、2>&1 >fileならエラー出力は元の標準出力のまま
+		if strings.HasPrefix(target.Text, "&") {
+			n, perr := strconv.Atoi(target.Text[1:])
+			f := fds[n]
+			if perr != nil || f == nil {
+				return fmt.Errorf("%s: bad file descriptor", target.Text[1:])
+			}
+			fds[fd] = f
+			i++
+			continue
+		}
+		name, perr := ca.Sh.ExpandVars(target.Text)
+		if perr != nil {
+			return perr
+		}
+
+		var f *os.File
+		if input {
+			f, perr = ca.open(name, os.O_RDONLY)
+		} else {
+			f, perr = ca.create(name, op == ">|")
+		}
+		if perr != nil {
+			return perr
 		}
+		fds[fd] = f
+		i++
+	}
+
+	in, out, err := fds[0], fds[1], fds[2]
+	if debugMode && (in != ca.Sh.In || out != ca.Sh.Out || err != ca.Sh.Err) {
+		debugf("redirect %q: stdin=%s stdout=%s stderr=%s", newCmd, in.Name(), out.Name(), err.Name())
 	}
 
 	// リダイレクト先をattrに設定
 	// デフォルト値はstdin, stdout, stderr
+	// 3以降で開いていないファイル記述子は子プロセスでも閉じる
 	ca.Cmd = newCmd
+	ca.In, ca.Out, ca.Err = in, out, err
+	ca.Fds = nil
 	ca.Attr = syscall.ProcAttr{
+		Dir:   ca.Sh.Dir,
+		Env:   ca.Sh.Environ(),
 		Files: []uintptr{in.Fd(), out.Fd(), err.Fd()},
 	}
+	for n, f := range fds {
+		if n < 3 {
+			continue
+		}
+		if ca.Fds == nil {
+			ca.Fds = map[int]*os.File{}
+		}
+		ca.Fds[n] = f
+		for len(ca.Attr.Files) <= n {
+			ca.Attr.Files = append(ca.Attr.Files, ^uintptr(0))
+		}
+		ca.Attr.Files[n] = f.Fd()
+	}
 	return nil
 }
 
-// A|B|C|DをA|B|CとDに分ける
-func ParsePipe(args []string) ([]string, []string) {
-	var args1, args2 []string
-
-	for i := len(args) - 1; i >= 0; i-- {
-		if args[i] == "|" {
-			args1 = make([]string, i)
-			copy(args1, args[:i])
-			args2 = args[i+1:]
-			break
-		}
-		if i == 0 {
-			args2 = args
+// リダイレクト記号か (<、>、>|と、2>や3<のような数字の付いたもの)
+func isRedirect(tok string) bool {
+	switch tok {
+	case "<", ">", ">|":
+		return true
+	}
+	n := len(tok) - 1
+	if n < 1 || (tok[n] != '>' && tok[n] != '<') {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if tok[i] < '0' || tok[i] > '9' {
+			return false
 		}
 	}
+	return true
+}
 
-	return args1, args2
+// リダイレクトできるファイル記述子の上限
+// 子プロセスに渡すファイル記述子の表が大きくなりすぎないようにする
+const maxRedirectFd = 1023
+
+// リダイレクト記号の対象のファイル記述子と、入力のリダイレクトか
+// 例: <は0と入力、>|は1と出力、3<は3と入力、10>は10と出力
+// 数字が大きすぎるときは-1を返す
+func redirectFd(op string) (int, bool) {
+	switch op {
+	case "<":
+		return 0, true
+	case ">", ">|":
+		return 1, false
+	}
+	n := len(op) - 1
+	fd, err := strconv.Atoi(op[:n])
+	if err != nil || fd > maxRedirectFd {
+		fd = -1
+	}
+	return fd, op[n] == '<'
 }
 
-// 入力を分離記号で分割する(ref: https://qiita.com/yoya/items/23ac2c490625c5d47ad9)
-func SplitMultiSep(s string, sep []string) []string {
-	var ret []string
-	ret = Split(s, sep[0])
-	if len(sep) > 1 {
-		ret2 := []string{}
-		for _, r := range ret {
-			ret2 = append(ret2, SplitMultiSep(r, sep[1:])...)
+// args[open]の(に対応する)の位置 (なければ-1)
+func closeParen(args []Token, open int) int {
+	depth := 0
+	for i := open; i < len(args); i++ {
+		switch {
+		case args[i].Is(OperatorToken, "("):
+			depth++
+		case args[i].Is(OperatorToken, ")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
 		}
-		ret = ret2
 	}
-	return ret
+	return -1
 }
 
-// sepを残したstrings.Split
-// ref: https://teratail.com/questions/345393
-func Split(s, sep string) (out []string) {
+// プロセス置換のコマンドをバックグラウンドで実行する
+// readなら<(cmd)としてcmdの出力を読むパイプを、そうでなければ>(cmd)としてcmdの入力に書くパイプを返す
+// 返したパイプはCloseFilesで閉じる
+// cmdは別のゴルーチンで実行するので、変数を同時に読み書きしないようにシェルのコピーを使う
+// パイプの各コマンドと同じく、組み込みコマンドや関数も実行できる
+func (ca *CmdArg) ProcSubst(args []Token, read bool) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	sub := CmdArg{Sh: ca.Sh.Clone()}
+	mine, theirs := pw, pr
+	if read {
+		mine, theirs = pr, pw
+		sub.Sh.Out = pw
+	} else {
+		sub.Sh.In = pr
+	}
+	if err := sub.ParseRedirect(args); err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, err
+	}
+	ca.opened = append(ca.opened, mine)
 
-	for len(s) > 0 {
-		i := strings.Index(s, sep)
-		if i == -1 {
-			out = append(out, s)
-			break
+	go func() {
+		defer sub.Sh.CloseExecFiles()
+		defer sub.CloseFiles()
+		defer theirs.Close()
+		_, err := runRecover(sub.Run)
+		if err != nil && !IsControl(err) {
+			sub.Sh.Error(err)
 		}
+	}()
+	return mine, nil
+}
+
+// 閉じたファイル
+// Fdが-1になるので、ForkExecは子プロセスでそのファイル記述子を閉じる
+// 組み込みコマンドから読み書きするとエラーになる (closedFileErrorでbad file descriptorにする)
+func closedFile() (*os.File, error) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return f, nil
+}
 
-		out = append(out, s[:i])
-		out = append(out, sep)
-		s = s[i+1:]
+// 組み込みコマンドがclosedFileを読み書きしたエラーを、bashと同じくbad file descriptorのエラーにする
+// 例: echo: write error: bad file descriptor
+// それ以外のエラーはそのまま返す
+func closedFileError(name string, err error) error {
+	var pe *os.PathError
+	if !errors.As(err, &pe) || !errors.Is(err, os.ErrClosed) {
+		return err
 	}
-	return out
+	return fmt.Errorf("%s: %s error: %w", name, pe.Op, syscall.EBADF)
 }
 
-// whitespaceはskip
-func SkipWhiteSpace(s []string) []string {
-	var out []string
-	for _, si := range s {
-		if si == " " {
-			continue
+// リダイレクト先のファイルを開く
+// 相対パスはシェルのカレントディレクトリから探す
+// 作成したファイルのパーミッションは0666からシェルのumaskを除いたものになる
+// 開いたファイルはCloseFilesで閉じる
+func (ca *CmdArg) open(name string, flag int) (*os.File, error) {
+	open := os.OpenFile
+	if name == os.DevNull {
+		open = openDevNull
+	}
+	var f *os.File
+	var err error
+	withUmask(ca.Sh.Umask, func() {
+		f, err = open(ca.Sh.abs(name), flag, 0666)
+	})
+	if err != nil {
+		return nil, relPathError(err, name)
+	}
+	ca.opened = append(ca.opened, f)
+	return f, nil
+}
+
+// /dev/nullは最初に一度だけ読み書きできるように開き、使うたびに複製する
+var devNull struct {
+	once sync.Once
+	f    *os.File
+	err  error
+}
+
+// os.OpenFileの代わりに/dev/nullを開く
+// 開き直さないので、flagとpermは使わない
+func openDevNull(name string, flag int, perm os.FileMode) (*os.File, error) {
+	devNull.once.Do(func() {
+		devNull.f, devNull.err = os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	})
+	if devNull.err != nil {
+		return nil, devNull.err
+	}
+
+	// 複製したfdが子プロセスに残らないようにする
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Dup(int(devNull.f.Fd()))
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, &os.PathError{Op: "dup", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// 出力先のファイルを作って開く
+// noclobberが有効なら、forceでない限り既存の通常ファイルは上書きしない
+func (ca *CmdArg) create(name string, force bool) (*os.File, error) {
+	if force || !ca.Sh.Options["noclobber"] {
+		return ca.open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	}
+
+	f, err := ca.open(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if !errors.Is(err, os.ErrExist) {
+		return f, err
+	}
+	// /dev/nullなどの通常ファイル以外には書き込める
+	if fi, serr := os.Stat(ca.Sh.abs(name)); serr == nil && !fi.Mode().IsRegular() {
+		return ca.open(name, os.O_WRONLY)
+	}
+	return nil, fmt.Errorf("%s: cannot overwrite existing file", name)
+}
+
+// ParseRedirectで開いたファイルを閉じる
+func (ca *CmdArg) CloseFiles() {
+	for _, f := range ca.opened {
+		f.Close()
+	}
+	ca.opened = nil
+}
+
+// A|B|C|DをA, B, C, Dに分ける
+func SplitPipe(args []Token) [][]Token {
+	var stages [][]Token
+
+	cond := false // [[ ]]の中
+	start := 0
+	for i, a := range args {
+		// [[ ]]の中の||はパイプではない
+		switch {
+		case a.Is(WordToken, "[[") && !cond:
+			cond = true
+		case a.Is(WordToken, "]]") && cond:
+			cond = false
+		}
+		if a.Is(OperatorToken, "|") && !cond {
+			stages = append(stages, args[start:i])
+			start = i + 1
+		}
+	}
+	return append(stages, args[start:])
+}
+
+// クォートと${...}の外で最初にsepが現れる位置
+func IndexUnquoted(s, sep string) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == 0 && depth == 0 && strings.HasPrefix(s[i:], sep):
+			return i
+		case c == '\\' && quote != '\'':
+			i++
+		// $?の?は3項間演算子ではない
+		case c == '$' && strings.HasPrefix(s[i+1:], "?"):
+			i++
+		case quote != '\'' && strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case quote != '\'' && c == '}' && depth > 0:
+			depth--
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case quote == c:
+			quote = 0
 		}
-		out = append(out, si)
 	}
-	return out
+	return -1
 }
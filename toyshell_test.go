@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TOYSHELL_TEST_MAINが空でなければ、テストの代わりにシェルとして動く (runMainで使う)
+func TestMain(m *testing.M) {
+	if os.Getenv("TOYSHELL_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// テストのバイナリをシェルとして起動し、標準入力をinputにしてargsで実行する
+func runMain(t *testing.T, input string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "TOYSHELL_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(input)
+	var out, errOut strings.Builder
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// srcを新しいシェルで実行し、標準出力と標準エラー出力と終了ステータスを返す
+func runShell(t *testing.T, src string) (string, string, int) {
+	t.Helper()
+	return runShellInput(t, src, "")
+}
+
+// 標準入力をinputにしてsrcを実行する
+func runShellInput(t *testing.T, src, input string) (string, string, int) {
+	t.Helper()
+	return runShellSetup(t, src, input, nil)
+}
+
+// setupでシェルを設定してからsrcを実行する (setupがnilなら何もしない)
+func runShellSetup(t *testing.T, src, input string, setup func(sh *Shell)) (string, string, int) {
+	t.Helper()
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	in, out, errf := open("in"), open("out"), open("err")
+	if _, err := io.WriteString(in, input); err != nil {
+		t.Fatal(err)
+	}
+	in.Seek(0, io.SeekStart)
+
+	sh := NewShell()
+	sh.Name = "toyshell"
+	sh.In, sh.Out, sh.Err = in, out, errf
+	if setup != nil {
+		setup(sh)
+	}
+	ca := CmdArg{Sh: sh}
+	status, err := ca.Eval(src)
+	if ec, ok := err.(*ExitControl); ok {
+		status = ec.Status
+	}
+	sh.Status = status
+	ca.RunTrap(trapExit)
+
+	read := func(f *os.File) string {
+		f.Seek(0, io.SeekStart)
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	return read(out), read(errf), sh.Status
+}
+
+func TestQuotedOperators(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"quoted pipe", `echo "|" '|' \|`, "| | |\n"},
+		{"quoted redirect", `echo ">" "<" '2>'`, "> < 2>\n"},
+		{"quoted ternary", `true "?" echo a ":" echo b; echo "?" ":"`, "? :\n"},
+		{"quoted parentheses", `echo "(" ')'`, "( )\n"},
+		{"pipe in variable", `x="a|b"; echo $x`, "a|b\n"},
+		{"quoted and unquoted pipe", `echo "|" | cat`, "|\n"},
+		{"quoted and unquoted redirect", `echo "<" ">" > f; cat < f`, "< >\n"},
+		{"quoted and unquoted ternary", `true ? echo "?" : echo ":"; false ? echo "?" : echo ":"`, "?\n:\n"},
+		{"escaped", `echo \? \: \< \>`, "? : < >\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"two stages", `echo a | cat`, "a\n"},
+		{"three stages", `printf 'b\na\n' | sort | head -n 1`, "a\n"},
+		{"status of last", `false | true; echo $?`, "0\n"},
+		{"pipestatus", `true | false | true; echo ${PIPESTATUS[@]}`, "0 1 0\n"},
+		{"pipefail", `set -o pipefail; false | true; echo $?`, "1\n"},
+		{"pipefail last failure", `set -o pipefail; sh -c 'exit 2' | sh -c 'exit 3' | true; echo $?`, "3\n"},
+		{"stages run concurrently", `yes | head -n 2`, "y\ny\n"},
+		{"builtin in copy", `x=1; echo 2 | read x; echo $x`, "1\n"},
+		{"continued line", "echo a |\ncat", "a\n"},
+		{"or in [[ ]]", `[[ a == b || b == b ]]; echo $?`, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%q: got %q (stderr %q), want %q", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestPipelineSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`echo a | | cat`, "syntax error near unexpected token `|'"},
+		{`| cat`, "syntax error near unexpected token `|'"},
+		{`echo a |; echo b`, "syntax error near unexpected token `;'"},
+		{`( echo a | )`, "syntax error near unexpected token `)'"},
+		{`{ echo a; } | | cat`, "syntax error near unexpected token `|'"},
+		{`echo a |`, "unexpected end of input"},
+		{`)`, "syntax error near unexpected token `)'"},
+		{`echo a )`, "syntax error near unexpected token `)'"},
+		{`echo a | cat )`, "syntax error near unexpected token `)'"},
+	}
+	for _, tt := range tests {
+		out, errOut, status := runShell(t, tt.src)
+		if out != "" || status != 2 || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q, status %d (stderr %q), want status 2 and %q", tt.src, out, status, errOut, tt.err)
+		}
+	}
+}
+
+// 代表的なコマンド行の字句解析
+func BenchmarkTokenize(b *testing.B) {
+	lines := []struct {
+		name, line string
+	}{
+		{"simple", `ls -l /tmp`},
+		{"pipeline", `cat file | grep -v '^#' | sort | uniq -c > out 2> err`},
+		{"quotes", `echo "a | b" 'c ; d' ${x:-"e f"} \| g`},
+		{"ternary", `test -f a ? echo yes : echo no`},
+		{"long", strings.Repeat(`echo "$x" | tr a-z A-Z > f; `, 100)},
+	}
+	for _, l := range lines {
+		b.Run(l.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Tokenize(l.line)
+			}
+		})
+	}
+}
+
+// 20段のパイプの構文解析と実行
+func BenchmarkPipeline(b *testing.B) {
+	stages := []string{"echo a"}
+	for len(stages) < 20 {
+		stages = append(stages, "cat")
+	}
+	src := strings.Join(stages, " | ")
+
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ParseList(Tokenize(src), 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("run", func(b *testing.B) {
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer null.Close()
+		sh := NewShell()
+		sh.Out = null
+		ca := CmdArg{Sh: sh}
+		for i := 0; i < b.N; i++ {
+			if status, _ := ca.Eval(src); status != 0 {
+				b.Fatalf("status %d", status)
+			}
+		}
+	})
+}
+
+func TestBuiltinRedirect(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, src, out string
+	}{
+		{"pwd", `pwd > f; cat f`, dir + "\n"},
+		{"echo", `echo hi > f; cat f`, "hi\n"},
+		{"stdout restored", `echo a > f; echo b; cat f`, "b\na\n"},
+		{"stderr", `cd nonexistent 2> f; echo $?; grep -c 'cd: nonexistent' f`, "1\n1\n"},
+		{"input", `echo x > f; read v < f; echo $v`, "x\n"},
+		{"printf", `printf '%s-' a b > f; cat f`, "a-b-"},
+		{"function", `g() { echo in; pwd; }; g > f; cat f`, "in\n" + dir + "\n"},
+		{"group", `{ echo a; echo b; } > f; cat f`, "a\nb\n"},
+		{"redirect before command", `> f echo hi; cat f`, "hi\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, "cd "+dir+"; "+tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+func TestProcSubst(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"diff same", `diff <(echo x) <(echo x); echo $?`, "0\n"},
+		{"diff different", `diff <(echo x) <(echo y) > /dev/null; echo $?`, "1\n"},
+		{"two inputs", `cat <(echo a) <(echo b)`, "a\nb\n"},
+		{"builtin reads", `read v < <(echo hi); echo $v`, "hi\n"},
+		{"input redirect", `wc -l < <(printf 'a\nb\n')`, "2\n"},
+		{"nested", `cat <(cat <(echo n))`, "n\n"},
+		{"variables", `V=v; cat <(echo $V)`, "v\n"},
+		{"write", `echo hi > >(cat > f); for ((i = 0; i < 100; i++)); do [ -s f ] ? break : sleep 0.05; done; cat f`, "hi\n"},
+		{"word argument", `echo x <(true)`, "x /dev/fd/3\n"},
+		{"function", `f() { echo in $1; }; cat <(f a)`, "in a\n"},
+		{"builtin", `cat <(printf '%s-' a b)`, "a-b-"},
+		{"function variables are copied", `V=1; f() { V=2; echo $V; }; cat <(f); echo $V`, "2\n1\n"},
+		{"builtin reads written input", `g() { read x; echo got $x > f; }; echo hi > >(g); for ((i = 0; i < 100; i++)); do [ -s f ] ? break : sleep 0.05; done; cat f`, "got hi\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+}
+
+// 置換の中のコマンドのエラーは、親のシェルがリダイレクトで標準エラー出力を差し替えていてもシェルの標準エラー出力に出る
+func TestProcSubstErrors(t *testing.T) {
+	src := `for ((i = 0; i < 10; i++)); do cat <(nosuchcmd$i); cd /nonexistent 2> /dev/null; done`
+	_, errOut, _ := runShell(t, src)
+	for i := 0; i < 10; i++ {
+		if want := fmt.Sprintf(`exec: "nosuchcmd%d"`, i); !strings.Contains(errOut, want) {
+			t.Errorf("stderr %q, want %q", errOut, want)
+		}
+	}
+}
+
+// 続けて実行したパイプとプロセス置換が、互いのファイルディスクリプタや変数を取り違えないこと
+func TestBackToBackPipelines(t *testing.T) {
+	fds := func() int {
+		ents, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip(err)
+		}
+		return len(ents)
+	}
+	before := fds()
+
+	var want strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&want, "%d\np%d\nq%d\n", i, i, i)
+	}
+	src := `for ((i = 1; i <= 20; i++)); do V=$i; echo $V | cat; cat <(echo p$V) | cat; V=x; cat < <(echo q$i); done`
+	out, errOut, _ := runShell(t, src)
+	if out != want.String() || errOut != "" {
+		t.Errorf("got %q (stderr %q), want %q", out, errOut, want.String())
+	}
+
+	// runShellが開いた3つのファイルを除けば、ディスクリプタは増えていない
+	if after := fds(); after > before+3 {
+		t.Errorf("%d file descriptors open after the loop, %d before", after, before)
+	}
+}
+
+func TestRedirectOrder(t *testing.T) {
+	both := `sh -c 'echo out; echo err >&2'`
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"file then dup", both + ` > f 2>&1; cat f`, "out\nerr\n", ""},
+		{"dup then file", both + ` 2>&1 > f; cat f`, "err\nout\n", ""},
+		{"stderr to file then stdout to stderr", both + ` 2> f >&2; cat f`, "out\nerr\n", ""},
+		{"no redirect", both, "out\n", "err\n"},
+		{"builtin file then dup", `{ echo out; echo err >&2; } > f 2>&1; cat f`, "out\nerr\n", ""},
+		{"builtin dup then file", `{ echo out; echo err >&2; } 2>&1 > f; cat f`, "err\nout\n", ""},
+		{"function", `g() { echo out; echo err >&2; }; g 2>&1 > f; cat f`, "err\nout\n", ""},
+		{"last redirect wins", `echo a > f > g; cat g; wc -c < f`, "a\n0\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src)
+			if out != tt.out || errOut != tt.err {
+				t.Errorf("%q: got %q (stderr %q), want %q (stderr %q)", tt.src, out, errOut, tt.out, tt.err)
+			}
+		})
+	}
+}
+
+func TestNoclobber(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"protected", `echo a > f; set -o noclobber; echo b > f; echo $?; cat f`, "1\na\n"},
+		{"short option", `echo a > f; set -C; echo b > f; echo $?; cat f`, "1\na\n"},
+		{"new file", `set -o noclobber; echo b > f; cat f`, "b\n"},
+		{"forced", `echo a > f; set -o noclobber; echo b >| f; cat f`, "b\n"},
+		{"forced without noclobber", `echo a > f; echo b >| f; cat f`, "b\n"},
+		{"stderr", `echo a > f; set -C; sh -c 'echo x >&2' 2> f; echo $?; cat f`, "1\na\n"},
+		{"device", `set -o noclobber; echo a > /dev/null; echo $?`, "0\n"},
+		{"turned off", `echo a > f; set -o noclobber; set +o noclobber; echo b > f; cat f`, "b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runShell(t, "cd "+t.TempDir()+"; "+tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+		})
+	}
+
+	_, errOut, _ := runShell(t, "cd "+t.TempDir()+"; echo a > f; set -C; echo b > f")
+	if !strings.Contains(errOut, "f: cannot overwrite existing file") {
+		t.Errorf("stderr %q, want cannot overwrite message", errOut)
+	}
+}
+
+func TestDevNull(t *testing.T) {
+	src := `echo a > /dev/null; echo b > /dev/null >&-; sh -c 'echo c >&2' 2> /dev/null; cat < /dev/null; echo d; echo e > /dev/null | cat`
+	for i := 0; i < 2; i++ {
+		out, _, _ := runShell(t, src)
+		if out != "d\n" {
+			t.Errorf("%q: got %q, want %q", src, out, "d\n")
+		}
+	}
+	// 複製したfdを閉じても、最初に開いた/dev/nullは閉じない
+	if devNull.f == nil {
+		t.Fatal("/dev/null is not cached")
+	}
+	if _, err := devNull.f.Write([]byte("x")); err != nil {
+		t.Errorf("cached /dev/null: %v", err)
+	}
+
+	ca := CmdArg{Sh: NewShell()}
+	f, err := ca.open(os.DevNull, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Fd() == devNull.f.Fd() {
+		t.Errorf("open returned the cached fd %d", f.Fd())
+	}
+	ca.CloseFiles()
+	if _, err := devNull.f.Write([]byte("x")); err != nil {
+		t.Errorf("cached /dev/null after CloseFiles: %v", err)
+	}
+}
+
+// > /dev/nullを繰り返す
+// openは開いておいた/dev/nullを複製し、OpenFileは毎回開き直す
+func BenchmarkDevNull(b *testing.B) {
+	b.Run("dup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			f, err := openDevNull(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+	b.Run("OpenFile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			f, err := os.OpenFile(os.DevNull, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+			if err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+	b.Run("command", func(b *testing.B) {
+		ca := CmdArg{Sh: NewShell()}
+		nodes, err := ParseList(Tokenize(`true > /dev/null 2> /dev/null`), 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < b.N; i++ {
+			ca.Exec(nodes)
+		}
+	})
+}
+
+func TestExitMessages(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"exit status is quiet", `sh -c 'exit 3'; echo $?`, "3\n", ""},
+		{"success", `true; echo $?`, "0\n", ""},
+		{"signal", `sh -c 'kill -TERM $$'; echo $?`, "143\n", "Terminated\n"},
+		{"core dump", `sh -c 'ulimit -c 0; kill -SEGV $$'; echo $?`, "139\n", "Segmentation fault\n"},
+		{"sigpipe is quiet", `yes | head -n 1`, "y\n", ""},
+		{"redirected stdout", `sh -c 'kill -TERM $$' > /dev/null`, "", "Terminated\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != tt.err {
+				t.Errorf("%q: got %q (stderr %q), want %q (stderr %q)", tt.src, out, errOut, tt.out, tt.err)
+			}
+		})
+	}
+}
+
+func TestPostExec(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      []string
+	}{
+		{"external", `sh -c 'exit 2'`, []string{"sh -c exit 2 = 2"}},
+		{"builtin", `echo a > /dev/null`, []string{"echo a = 0"}},
+		{"[[ ]]", `[[ a == b ]]; [[ $x == '' ]]`, []string{"[[ a == b ]] = 1", "[[ $x == '' ]] = 0"}},
+		{"pipeline", `echo a | cat > /dev/null`, []string{"echo a = 0", "cat = 0"}},
+		{"empty command", `$empty`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []string
+			runShellSetup(t, tt.src, "", func(sh *Shell) {
+				sh.PostExec = func(cmd []string, status int) {
+					mu.Lock()
+					defer mu.Unlock()
+					got = append(got, fmt.Sprintf("%s = %d", strings.Join(cmd, " "), status))
+				}
+			})
+			sort.Strings(got)
+			want := append([]string{}, tt.want...)
+			sort.Strings(want)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("%q: PostExec got %q, want %q", tt.src, got, want)
+			}
+		})
+	}
+}
+
+func TestPreExec(t *testing.T) {
+	tests := []struct {
+		name, src, out, err string
+	}{
+		{"allowed", `sh -c 'echo ok'`, "ok\n", ""},
+		{"refused", `sh -c 'echo no'; echo $?`, "1\n", ""},
+		{"builtins skip the hook", `echo no`, "no\n", ""},
+		{"error", `sh fail; echo $?`, "1\n", "refused fail"},
+		{"expanded words", `x=ok; sh -c "echo $x"`, "ok\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen [][]string
+			out, errOut, _ := runShellSetup(t, tt.src, "", func(sh *Shell) {
+				sh.PreExec = func(cmd []string) (bool, error) {
+					seen = append(seen, cmd)
+					if len(cmd) > 1 && cmd[1] == "fail" {
+						return false, fmt.Errorf("refused %s", cmd[1])
+					}
+					return !strings.Contains(strings.Join(cmd, " "), "no"), nil
+				}
+			})
+			if out != tt.out || !strings.Contains(errOut, tt.err) {
+				t.Errorf("%q: got %q (stderr %q), want %q (stderr %q)", tt.src, out, errOut, tt.out, tt.err)
+			}
+			for _, cmd := range seen {
+				if cmd[0] == "echo" {
+					t.Errorf("%q: PreExec called for builtin %q", tt.src, cmd)
+				}
+			}
+		})
+	}
+}
+
+func TestBuiltinSigpipe(t *testing.T) {
+	words := make([]string, 10000)
+	for i := range words {
+		words[i] = strconv.Itoa(i + 1)
+	}
+	tests := []struct {
+		name, src, out string
+	}{
+		{"echo loop", `for i in ` + strings.Join(words, " ") + `; do echo y; done | head -n1; echo ${PIPESTATUS[@]}`, "y\n141 0\n"},
+		{"printf loop", `for ((i = 0; i < 10000; i++)); do printf 'y\n'; done | head -n1; echo ${PIPESTATUS[@]}`, "y\n141 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || errOut != "" {
+				t.Errorf("%s: got %q (stderr %q), want %q", tt.name, out, errOut, tt.out)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+	}{
+		{"kills slow command", `set timeout 1; sleep 10; echo $?`, "124\n"},
+		{"fast command", `set timeout 1; sleep 0; echo $?`, "0\n"},
+		{"show", `set timeout 3; set timeout`, "timeout 3\n"},
+		{"default", `set timeout`, "timeout 0\n"},
+		{"disable", `set timeout 1; set timeout 0; sh -c 'sleep 1.5; echo done'`, "done\n"},
+		{"invalid", `set timeout x; echo $?; set timeout`, "1\ntimeout 0\n"},
+		{"kills grandchildren", `cd ` + t.TempDir() + `; set timeout 1; sh -c 'sh -c "sleep 2; touch late"; true'; echo $?; set timeout 0; sleep 2.5; [ -e late ]; echo $?`, "124\n1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			out, _, _ := runShell(t, tt.src)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.src, out, tt.out)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("%q: took %v", tt.src, d)
+			}
+		})
+	}
+
+	_, errOut, _ := runShell(t, `set timeout 1; sleep 10`)
+	if !strings.Contains(errOut, "sleep: timed out after 1 seconds") {
+		t.Errorf("stderr %q, want timeout message", errOut)
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	for _, line := range []string{"", " ", "   ", "\t", "\t\t", " \t ", "\t \t", " \t\r"} {
+		if toks := Tokenize(line); len(toks) != 0 {
+			t.Errorf("Tokenize(%q) = %v, want no tokens", line, toks)
+		}
+	}
+
+	tests := []struct {
+		name, input, out string
+		status           int
+	}{
+		{"spaces", "   \necho a\n", "a\n", 0},
+		{"tabs", "\t\t\necho a\n", "a\n", 0},
+		{"mixed", " \t \n\t \necho a\n \t\n", "a\n", 0},
+		{"status kept", "sh -c 'exit 3'\n  \n\t\n", "", 3},
+		{"status after blank line", "sh -c 'exit 3'\n \t \necho $?\n", "3\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 空白だけの行を空のコマンドとして実行しない
+			out, errOut, status := runMain(t, tt.input)
+			if out != tt.out || strings.Contains(errOut, "not found") || status != tt.status {
+				t.Errorf("%q: got %q, status %d (stderr %q), want %q, status %d", tt.input, out, status, errOut, tt.out, tt.status)
+			}
+		})
+	}
+}
+
+func TestErrorLineNumbers(t *testing.T) {
+	tests := []struct {
+		name, script, err string
+	}{
+		{"first line", "cd /nonexistent\n", "line 1: cd: /nonexistent"},
+		{"after blank lines", "echo a\n\n\ncd /nonexistent\n", "line 4: cd: /nonexistent"},
+		{"command not found", "echo a\nnosuchcmd\n", "line 2: exec: \"nosuchcmd\""},
+		{"loop body", "for i in 1; do\n  cd /nonexistent\ndone\n", "line 2: cd: /nonexistent"},
+		{"function body", "f() {\n  cd /nonexistent\n}\necho a\nf\n", "line 2: cd: /nonexistent"},
+		{"expansion", "echo a\necho ${V:?msg}\n", "line 2: V: msg"},
+		{"syntax error", "echo a\necho b\ndone\n", "line 3: syntax error near unexpected token `done'"},
+		{"unfinished loop", "for i in 1; do\necho a\n", "line 2: syntax error: unexpected end of input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := filepath.Join(t.TempDir(), "s.sh")
+			if err := os.WriteFile(script, []byte(tt.script), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, errOut, _ := runMain(t, "", script)
+			if want := "toyshell: " + script + ": " + tt.err; !strings.Contains(errOut, want) {
+				t.Errorf("%q: stderr %q, want %q", tt.script, errOut, want)
+			}
+		})
+	}
+}
+
+func TestErrorName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		args  []string
+		err   string
+	}{
+		{"stdin", "echo a\nnosuchcmd\n", nil, "toyshell: line 2: exec: \"nosuchcmd\""},
+		{"command string", "", []string{"-c", "nosuchcmd"}, "toyshell: line 1: exec: \"nosuchcmd\""},
+		{"named command string", "", []string{"-c", "nosuchcmd", "myname"}, "toyshell: myname: line 1: exec: \"nosuchcmd\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errOut, _ := runMain(t, tt.input, tt.args...)
+			if !strings.HasPrefix(errOut, tt.err) {
+				t.Errorf("%q: stderr %q, want prefix %q", tt.args, errOut, tt.err)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorCaret(t *testing.T) {
+	tests := []struct {
+		name, input, caret string
+	}{
+		{"pipe", "echo a | | b\n", "echo a | | b\n         ^\n"},
+		{"identifier", "for 1x in a; do echo; done\n", "for 1x in a; do echo; done\n    ^\n"},
+		{"indented", "  ( | x )\n", "  ( | x )\n    ^\n"},
+		{"continuation line", "for i in a\ndo echo | ; done\n", "do echo | ; done\n          ^\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errOut, status := runMain(t, tt.input)
+			if status != 2 || !strings.HasSuffix(errOut, tt.caret) {
+				t.Errorf("%q: status %d, stderr %q, want suffix %q", tt.input, status, errOut, tt.caret)
+			}
+		})
+	}
+}
+
+// 擬似端末を開いて、制御側と端末側を返す (使えなければテストをスキップする)
+func openPty(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { ptm.Close() })
+	var unlock int32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, ptm.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		t.Skip(e)
+	}
+	var n uint32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, ptm.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); e != 0 {
+		t.Skip(e)
+	}
+	pts, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { pts.Close() })
+	return ptm, pts
+}
+
+func TestColor(t *testing.T) {
+	ptm, tty := openPty(t)
+	file, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	colored := colorRed + "x" + colorReset
+	tests := []struct {
+		name  string
+		f     *os.File
+		color bool
+		env   string
+		want  string
+	}{
+		{"terminal", tty, true, "", colored},
+		{"option off", tty, false, "", "x"},
+		{"not a terminal", file, true, "", "x"},
+		{"NO_COLOR", tty, true, "1", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh := NewShell()
+			sh.Options["color"] = tt.color
+			sh.Vars["NO_COLOR"] = tt.env
+			if got := sh.Color(tt.f, colorRed, "x"); got != tt.want {
+				t.Errorf("Color = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// 端末でなければcommand not foundに色を付けない
+	_, errOut, _ := runShell(t, `set -o color; nosuchcmd`)
+	if !strings.Contains(errOut, "nosuchcmd") || strings.Contains(errOut, "\x1b[") {
+		t.Errorf("stderr %q, want an uncolored message", errOut)
+	}
+	// 端末ならcommand not foundは赤になる
+	sh := NewShell()
+	sh.Options["color"] = true
+	sh.Err = tty
+	sh.Error(fmt.Errorf("nosuchcmd: %w", exec.ErrNotFound))
+	buf := make([]byte, 256)
+	n, err := ptm.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.Contains(got, colorRed+"nosuchcmd: ") {
+		t.Errorf("not found message %q is not red", got)
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	// パイプから読むときはプロンプトを出さない
+	for _, input := range []string{"", "echo a\n", "echo a\n\necho b\n", "read x\nline\necho $x\n"} {
+		out, errOut, _ := runMain(t, input)
+		if strings.Contains(out+errOut, "myshell") || strings.Contains(out+errOut, "]> ") {
+			t.Errorf("%q: prompt in output %q (stderr %q)", input, out, errOut)
+		}
+	}
+
+	// 端末から読むときはプロンプトを出す
+	if out := runInteractive(t, "exit\n", nil); !strings.Contains(out, "./myshell[0]> ") {
+		t.Errorf("interactive output %q has no prompt", out)
+	}
+
+	// set -o colorで端末に出すときは、カレントディレクトリだけに色を付ける
+	_, tty := openPty(t)
+	sh := NewShell()
+	sh.Dir = "/tmp/dir"
+	if got, want := sh.Prompt(tty, 2), "/tmp/dir ./myshell[2]> "; got != want {
+		t.Errorf("Prompt = %q, want %q", got, want)
+	}
+	sh.Options["color"] = true
+	if got, want := sh.Prompt(tty, 2), colorBlue+"/tmp/dir"+colorReset+" ./myshell[2]> "; got != want {
+		t.Errorf("colored Prompt = %q, want %q", got, want)
+	}
+}
+
+func TestPromptCommand(t *testing.T) {
+	out := runInteractive(t, "echo a\necho b\nexit\n", []string{"PROMPT_COMMAND=echo pc"})
+	if n := strings.Count(out, "pc\n"); n != 3 {
+		t.Errorf("PROMPT_COMMAND ran %d times, want 3 (output %q)", n, out)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "pc\n"+wd+" ./myshell[0]> a\npc\n") {
+		t.Errorf("PROMPT_COMMAND does not run before each prompt: %q", out)
+	}
+
+	// $?はPROMPT_COMMANDの前の値のまま
+	out = runInteractive(t, "sh -c 'exit 3'\necho status $?\nexit\n", []string{"PROMPT_COMMAND=true"})
+	if !strings.Contains(out, "status 3\n") {
+		t.Errorf("$? after PROMPT_COMMAND: %q", out)
+	}
+}
+
+// 標準入力を擬似端末にしてテストのバイナリをシェルとしてargsで起動し、inputを入力して標準出力を返す
+// envは追加する環境変数。HOMEは空のディレクトリにする
+func runInteractive(t *testing.T, input string, env []string, args ...string) string {
+	t.Helper()
+	ptm, tty := openPty(t)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), "TOYSHELL_TEST_MAIN=1", "HOME="+t.TempDir()), env...)
+	var out strings.Builder
+	cmd.Stdin, cmd.Stdout = tty, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptm.Write([]byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("interactive shell did not exit")
+	}
+	return out.String()
+}
+
+func TestCommandString(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		out    string
+		status int
+	}{
+		{"pipeline", []string{"-c", "echo a b | wc -w"}, "2\n", 0},
+		{"builtin pipeline", []string{"-c", "echo a | tr a b | cat"}, "b\n", 0},
+		{"list", []string{"-c", "echo a; echo b"}, "a\nb\n", 0},
+		{"lines", []string{"-c", "echo a\necho b"}, "a\nb\n", 0},
+		{"exit", []string{"-c", "echo a; exit 3; echo b"}, "a\n", 3},
+		{"last status", []string{"-c", "false"}, "", 1},
+		{"pipeline status", []string{"-c", "false | true"}, "", 0},
+		{"pipefail", []string{"-c", "set -o pipefail; false | true"}, "", 1},
+		{"exit trap", []string{"-c", "trap 'echo bye' EXIT; exit 3"}, "bye\n", 3},
+		{"positional parameters", []string{"-c", "echo $0 $# $1 $2", "name", "a", "b"}, "name 2 a b\n", 0},
+		{"does not read stdin", []string{"-c", "echo a"}, "a\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, status := runMain(t, "echo stdin\n", tt.args...)
+			if out != tt.out || status != tt.status {
+				t.Errorf("%q: got %q, status %d, want %q, status %d", tt.args, out, status, tt.out, tt.status)
+			}
+		})
+	}
+
+	_, errOut, status := runMain(t, "", "-c")
+	if status != 2 || !strings.Contains(errOut, "-c: option requires an argument") {
+		t.Errorf("-c without a string: status %d (stderr %q)", status, errOut)
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	long := strings.Repeat("a", 100*1024)
+	tests := []struct {
+		name, input, out string
+	}{
+		{"echo", "echo " + long + "\necho done\n", long + "\ndone\n"},
+		{"many words", "echo" + strings.Repeat(" ab", 40*1024) + " | wc -w\n", "40960\n"},
+		{"assignment", "x=" + long + "\necho ${#x}\n", "102400\n"},
+		{"read", "read x\n" + long + "\necho ${#x}\n", "102400\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, status := runMain(t, tt.input)
+			if out != tt.out || errOut != "" || status != 0 {
+				t.Errorf("got %d bytes %.40q, status %d (stderr %q), want %d bytes %.40q", len(out), out, status, errOut, len(tt.out), tt.out)
+			}
+		})
+	}
+
+	// スクリプトファイルでも同じ
+	script := filepath.Join(t.TempDir(), "long.sh")
+	if err := os.WriteFile(script, []byte("echo "+long+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, errOut, _ := runMain(t, "", script); out != long+"\n" {
+		t.Errorf("script: got %d bytes (stderr %q), want %d", len(out), errOut, len(long)+1)
+	}
+
+	scanner := NewInputScanner(strings.NewReader(long + long + "\nnext\n"))
+	if line, err := ReadLine(scanner); err != nil || line != long+long {
+		t.Errorf("ReadLine: got %d bytes, %v", len(line), err)
+	}
+	if line, err := ReadLine(scanner); err != nil || line != "next" {
+		t.Errorf("ReadLine after the long line: got %q, %v", line, err)
+	}
+}
+
+func TestStartupFiles(t *testing.T) {
+	home := t.TempDir()
+	files := map[string]string{
+		".toyshell_profile": "echo profile\n",
+		".toyshellrc":       "echo rc\nrcfn() { echo rcfn; }\n",
+		"other_rc":          "echo other\n",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(home, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := []string{"HOME=" + home}
+
+	// 対話モード
+	tests := []struct {
+		name      string
+		args      []string
+		want, not []string
+	}{
+		{"rc", nil, []string{"rc\n", "rcfn\n"}, []string{"profile", "other"}},
+		{"login", []string{"-l"}, []string{"profile\n"}, []string{"rc\n", "other"}},
+		{"rcfile", []string{"--rcfile", filepath.Join(home, "other_rc")}, []string{"other\n"}, []string{"profile", "rc\n"}},
+		{"norc", []string{"--norc"}, nil, []string{"profile", "rc\n", "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := runInteractive(t, "rcfn\nexit\n", env, tt.args...)
+			for _, w := range tt.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("%q: output %q does not contain %q", tt.args, out, w)
+				}
+			}
+			for _, n := range tt.not {
+				if strings.Contains(out, n) {
+					t.Errorf("%q: output %q contains %q", tt.args, out, n)
+				}
+			}
+		})
+	}
+
+	// パイプから読むときはrcを読まず、-lならprofileを読む
+	runPiped := func(args ...string) string {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), "TOYSHELL_TEST_MAIN=1", "HOME="+home)
+		cmd.Stdin = strings.NewReader("echo main\n")
+		out, _ := cmd.Output()
+		return string(out)
+	}
+	if out := runPiped(); out != "main\n" {
+		t.Errorf("piped: got %q, want %q", out, "main\n")
+	}
+	if out := runPiped("-l"); out != "profile\nmain\n" {
+		t.Errorf("piped -l: got %q, want %q", out, "profile\nmain\n")
+	}
+
+	// --rcfileで指定したファイルがなければエラー
+	out := runInteractive(t, "exit\n", env, "--rcfile", filepath.Join(home, "nonexistent"))
+	if strings.Contains(out, "rc\n") {
+		t.Errorf("missing rcfile: fell back to ~/.toyshellrc: %q", out)
+	}
+	if _, errOut, status := runMain(t, "", "--rcfile"); status != 2 || !strings.Contains(errOut, "--rcfile: option requires an argument") {
+		t.Errorf("--rcfile without a file: status %d (stderr %q)", status, errOut)
+	}
+}
+
+func TestStdinScript(t *testing.T) {
+	tests := []struct {
+		name, input, out string
+	}{
+		{"read takes the next line", "read x\nhello\necho [$x]\n", "[hello]\n"},
+		{"read twice", "read a\n1\nread b\n2\necho $a $b\n", "1 2\n"},
+		{"external command reads the rest", "sh -c 'read l; echo got $l'\nline\necho done\n", "got line\ndone\n"},
+		{"no trailing newline", "echo a", "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, _ := runMain(t, tt.input)
+			if out != tt.out {
+				t.Errorf("%q: got %q, want %q", tt.input, out, tt.out)
+			}
+		})
+	}
+	if _, _, status := runMain(t, "sh -c 'exit 3'\n"); status != 3 {
+		t.Errorf("exit status %d, want 3", status)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	builtins["panic"] = func(ca *CmdArg, args []string) (int, error) {
+		panic("boom")
+	}
+	defer delete(builtins, "panic")
+
+	tests := []struct {
+		name, src, out string
+	}{
+		{"first stage", `panic | cat; echo ${PIPESTATUS[@]}`, "1 0\n"},
+		{"last stage", `echo a | panic; echo $?`, "1\n"},
+		{"middle stage", `true | panic | cat; echo ${PIPESTATUS[@]}`, "0 1 0\n"},
+		{"group stage", `{ panic; } | cat; echo ${PIPESTATUS[@]}`, "1 0\n"},
+		{"shell keeps running", `echo a | panic; echo after`, "after\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errOut, _ := runShell(t, tt.src)
+			if out != tt.out || !strings.Contains(errOut, "internal error: boom") {
+				t.Errorf("%q: got %q (stderr %q), want %q and an internal error", tt.src, out, errOut, tt.out)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	rc := filepath.Join(dir, "rc")
+	// パイプの外でpanicすると起動ファイルの残りは実行しない
+	if err := os.WriteFile(rc, []byte("echo sourced\npanic\necho skipped\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, errOut, _ := runShellSetup(t, "echo after", "", func(sh *Shell) {
+		ca := CmdArg{Sh: sh}
+		ca.SourceStartup(rc, true)
+	})
+	if out != "sourced\nafter\n" || !strings.Contains(errOut, "internal error: boom") {
+		t.Errorf("startup file: got %q (stderr %q)", out, errOut)
+	}
+}
+
+func TestIntTrap(t *testing.T) {
+	// trapは次の外部コマンドの前か次の行を読んだあとに実行する
+	input := "trap 'echo caught' INT\nkill -INT $$; sleep 0.1\necho after\ntrap - INT\necho done\n"
+	out, errOut, status := runMain(t, input)
+	if out != "caught\nafter\ndone\n" || status != 0 {
+		t.Errorf("got %q (stderr %q, status %d)", out, errOut, status)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+/*
+	trap組み込みコマンド
+*/
+// trapで使えるシグナルの名前 (SIGを除いたもの)
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// シグナル以外のtrap
+// EXITはシェルの終了時、ERRは0以外の終了ステータスで終わったコマンドの後に実行する
+const (
+	trapExit = "EXIT"
+	trapErr  = "ERR"
+)
+
+// trap [-p] [[command] signal...]
+// signalを受け取ったらcommandを実行する。commandが-ならtrapを消し、空文字列ならシグナルを無視する
+// 引数がなければ (-pでも) 設定したtrapを一覧表示する
+func Trap(ca *CmdArg, args []string) (int, error) {
+	sh := ca.Sh
+	args = args[1:]
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+		if len(args) == 0 {
+			sh.printTraps(nil)
+			return 0, nil
+		}
+		if err := sh.printTraps(args); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		sh.printTraps(nil)
+		return 0, nil
+	}
+
+	// trap INTのようにcommandを省略したら消す
+	cmd, sigs := args[0], args[1:]
+	if _, err := trapName(cmd); err == nil && len(sigs) == 0 {
+		cmd, sigs = "-", args
+	}
+	if len(sigs) == 0 {
+		return 2, fmt.Errorf("trap: usage: trap [-p] [[command] signal...]")
+	}
+
+	status := 0
+	for _, s := range sigs {
+		name, err := trapName(s)
+		if err != nil {
+			sh.Error(fmt.Errorf("trap: %w", err))
+			status = 1
+			continue
+		}
+		if cmd == "-" {
+			delete(sh.Traps, name)
+		} else {
+			sh.Traps[name] = cmd
+		}
+	}
+	sh.notifyTraps()
+	return status, nil
+}
+
+// シグナルの名前 (SIGINT、INT、2など) をtrapのキーにする
+func trapName(s string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if name == trapExit || name == trapErr {
+		return name, nil
+	}
+	if _, ok := signalNames[name]; ok {
+		return name, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n == 0 {
+			return trapExit, nil
+		}
+		for name, sig := range signalNames {
+			if int(sig) == n {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: invalid signal specification", s)
+}
+
+// trapを設定したシグナルを受け取るようにする
+// コピーのシェルで設定したtrapは、元のシェルが受け取るシグナルを変えない
+func (sh *Shell) notifyTraps() {
+	if sh.noTraps {
+		return
+	}
+	var sigs []os.Signal
+	for name := range sh.Traps {
+		if sig, ok := signalNames[name]; ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	sh.sig.notify(sigs)
+}
+
+// trapをtrapコマンドの形で表示する
+// namesが空なら全部。EXITを先にして、シグナルの番号順に並べる
+func (sh *Shell) printTraps(names []string) error {
+	if len(names) == 0 {
+		for name := range sh.Traps {
+			names = append(names, name)
+		}
+	}
+	keys := make([]string, 0, len(names))
+	for _, s := range names {
+		name, err := trapName(s)
+		if err != nil {
+			return fmt.Errorf("trap: %w", err)
+		}
+		keys = append(keys, name)
+	}
+	order := func(name string) int {
+		switch name {
+		case trapExit:
+			return 0
+		case trapErr:
+			return 100
+		}
+		return int(signalNames[name])
+	}
+	sort.Slice(keys, func(i, j int) bool { return order(keys[i]) < order(keys[j]) })
+
+	for _, name := range keys {
+		cmd, ok := sh.Traps[name]
+		if !ok {
+			continue
+		}
+		sig := name
+		if _, isSig := signalNames[name]; isSig {
+			sig = "SIG" + name
+		}
+		fmt.Fprintf(sh.Out, "trap -- %s %s\n", shellQuote(cmd), sig)
+	}
+	return nil
+}
+
+// シェルの入力として読める形にクォートする
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// 受け取ったシグナルのtrapを実行する
+// コマンドの実行中に受け取ったシグナルは、そのコマンドが終わってから処理する
+// trapのコマンドがexitを実行したら、残りのtrapは実行せずにExitControlを返す
+func (ca *CmdArg) RunTraps() error {
+	if ca.Sh.noTraps {
+		return nil
+	}
+	for _, s := range ca.Sh.sig.takePending() {
+		for name, sig := range signalNames {
+			if sig != s {
+				continue
+			}
+			if err := ca.RunTrap(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nameのtrapがあれば実行する
+// trapの中ではtrapを実行しない
+// trapのコマンドがexitを実行したらExitControlを返す
+func (ca *CmdArg) RunTrap(name string) error {
+	cmd, ok := ca.Sh.Traps[name]
+	if !ok || cmd == "" || ca.Sh.inTrap {
+		return nil
+	}
+	ca.Sh.inTrap = true
+	defer func() { ca.Sh.inTrap = false }()
+	return ca.EvalHook(cmd)
+}
+
+/*
+	シグナルの振り分け
+*/
+// シェルが受け取ったシグナルを、trapと実行中の外部コマンドに振り分ける
+// シェルとそのコピー (パイプの中のコマンドなど) で共有する
+//
+// trapを設定したシグナルは外部コマンドに転送せず、pendingに入れてRunTrapsで実行する
+// それ以外のSIGINTは、そのとき実行中の外部コマンドだけに転送する
+// 外部コマンドを実行していなければ、forループを止めるためにinterruptedを立てる
+type sigState struct {
+	mu          sync.Mutex
+	ch          chan os.Signal       // signal.Notifyで受け取るチャネル (何も受け取らなければnil)
+	interrupt   bool                 // SIGINTを受け取るか (HandleInterrupt)
+	trapped     map[os.Signal]bool   // trapを設定したシグナル
+	children    map[*os.Process]bool // 実行中の外部コマンドと、SIGINTを転送したか
+	pending     []os.Signal          // まだtrapを実行していないシグナル
+	interrupted bool                 // 外部コマンドの実行中以外にSIGINTを受け取ったか
+}
+
+func newSigState() *sigState {
+	return &sigState{
+		trapped:  map[os.Signal]bool{},
+		children: map[*os.Process]bool{},
+	}
+}
+
+// SIGINTでシェルを終了せず、実行中の外部コマンドに転送するようにする
+func (sh *Shell) HandleInterrupt() {
+	sh.sig.mu.Lock()
+	sh.sig.interrupt = true
+	sh.sig.mu.Unlock()
+	sh.notifyTraps()
+}
+
+// trappedとSIGINTを受け取るようにする
+// 受け取るシグナルがなくなったら、dispatchのゴルーチンを終わらせる
+func (d *sigState) notify(trapped []os.Signal) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.trapped = map[os.Signal]bool{}
+	for _, sig := range trapped {
+		d.trapped[sig] = true
+	}
+	sigs := trapped
+	if d.interrupt {
+		sigs = append(sigs, syscall.SIGINT)
+	}
+
+	if d.ch != nil {
+		signal.Stop(d.ch)
+		if len(sigs) == 0 {
+			close(d.ch)
+			d.ch = nil
+			return
+		}
+	} else {
+		if len(sigs) == 0 {
+			return
+		}
+		d.ch = make(chan os.Signal, len(signalNames))
+		go d.dispatch(d.ch)
+	}
+	signal.Notify(d.ch, sigs...)
+}
+
+// 受け取ったシグナルを振り分ける
+func (d *sigState) dispatch(ch <-chan os.Signal) {
+	for s := range ch {
+		d.mu.Lock()
+		switch {
+		case d.trapped[s]:
+			d.pending = append(d.pending, s)
+		case len(d.children) > 0:
+			for proc := range d.children {
+				proc.Signal(s)
+				d.children[proc] = true
+			}
+		default:
+			d.interrupted = true
+		}
+		d.mu.Unlock()
+	}
+}
+
+// trapを実行していないシグナルを取り出す
+func (d *sigState) takePending() []os.Signal {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sigs := d.pending
+	d.pending = nil
+	return sigs
+}
+
+// 外部コマンドの実行中以外にSIGINTを受け取ったかを返し、忘れる
+func (d *sigState) takeInterrupt() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	intr := d.interrupted
+	d.interrupted = false
+	return intr
+}
+
+// procの実行中に受け取ったSIGINTをprocに転送する
+func (d *sigState) startChild(proc *os.Process) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.children[proc] = false
+}
+
+// procが終わったので転送をやめる。SIGINTを転送したかを返す
+func (d *sigState) endChild(proc *os.Process) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	caught := d.children[proc]
+	delete(d.children, proc)
+	return caught
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrap(t *testing.T) {
+	tests := []struct {
+		name, src, out string
+		status         int
+	}{
+		{"exit trap on exit", `trap 'echo bye' EXIT; exit 3`, "bye\n", 3},
+		{"exit trap at end", `trap 'echo bye' EXIT; echo a`, "a\nbye\n", 0},
+		{"exit trap sees status", `trap 'echo status $?' EXIT; exit 4`, "status 4\n", 4},
+		{"exit in exit trap", `trap 'echo bye; exit 5' EXIT; exit 3`, "bye\n", 3},
+		{"exit trap by number", `trap 'echo bye' 0; true`, "bye\n", 0},
+		{"remove", `trap 'echo bye' EXIT; trap - EXIT; exit 1`, "", 1},
+		{"remove without dash", `trap 'echo bye' EXIT; trap EXIT`, "", 0},
+		{"err trap", `trap 'echo err' ERR; sh -c 'exit 1'; true; sh -c 'exit 2'`, "err\nerr\n", 2},
+		{"err trap keeps status", `trap 'true' ERR; sh -c 'exit 2'; echo $?`, "2\n", 0},
+		{"list", `trap 'echo usr1' USR1; trap 'echo bye' EXIT; trap -p`, "trap -- 'echo bye' EXIT\ntrap -- 'echo usr1' SIGUSR1\nbye\n", 0},
+		{"list one", `trap 'echo bye' EXIT; trap 'echo usr1' SIGUSR1; trap -p USR1`, "trap -- 'echo usr1' SIGUSR1\nbye\n", 0},
+		{"quote", `trap "echo 'a b'" EXIT; trap -p EXIT; trap - EXIT`, "trap -- 'echo '\\''a b'\\''' EXIT\n", 0},
+		{"pipeline stage", `trap 'echo bye' EXIT | cat; trap -p`, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, _, status := runShell(t, tt.src)
+			if out != tt.out || status != tt.status {
+				t.Errorf("%q: got %q, status %d, want %q, status %d", tt.src, out, status, tt.out, tt.status)
+			}
+		})
+	}
+
+	if out, _, status := runMain(t, "trap 'echo bye' EXIT\nexit 3\necho no\n"); out != "bye\n" || status != 3 {
+		t.Errorf("script: got %q, status %d, want %q, status 3", out, status, "bye\n")
+	}
+}
+
+func TestTrapErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`trap 'echo' NOSUCH`, "NOSUCH: invalid signal specification"},
+		{`trap -p NOSUCH`, "NOSUCH: invalid signal specification"},
+		{`trap 'echo'`, "usage"},
+	}
+	for _, tt := range tests {
+		out, errOut, _ := runShell(t, tt.src+"; echo $?")
+		if out == "0\n" || !strings.Contains(errOut, tt.err) {
+			t.Errorf("%q: got %q (stderr %q), want failure and %q", tt.src, out, errOut, tt.err)
+		}
+	}
+}